@@ -1,11 +1,15 @@
-// Extensible line-number Basic interpreter in under 1000 lines of Go.
+// Extensible line-number Basic interpreter in Go.
 package main
 
 import (
 	"fmt"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
 	"errors"
 	"unicode"
 	"strings"
+	"unicode/utf8"
 	"strconv"
 	"math"
 	"math/rand"
@@ -14,6 +18,11 @@ import (
 	"time"
 	"bufio"
 	"os"
+	"flag"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"unsafe"
 )
 
 var Ins = os.Stdin
@@ -41,11 +50,195 @@ type Context struct {
 	Variables
 	Program
 	
+	In io.Reader
+	Out io.Writer
+	Err io.Writer
+	TraceOut io.Writer // Where TRON reports line numbers.
+	
+	MaxSteps int // Give up after this many statements; 0 means no limit.
+	MaxStackDepth int // Limit on GOSUB and loop nesting; 0 means none.
+	MaxLineNumber int // Highest line RENUM may use; 0 means no limit.
+	MaxInputRetries int // How often INPUT asks again; 0 means no limit.
+	AngleMode AngleUnit // What trigonometric functions work in.
+	TruthNames bool // PRINT comparisons as TRUE/FALSE instead of -1/0.
+	PrintFormat string // How PRINT formats numbers, e.g. "%.2f".
+	CommaSep string // What PRINT puts between items at a comma, e.g. "\t".
+	AutoZero bool // Read unset variables as 0, like classic BASIC.
+	Warnings []Warning // Suspicious but legal things seen so far.
+	AllowShell bool // Let SHELL run commands; off by default.
+	AllowEnviron bool // Let ENVIRON$ and SETENV use the environment.
+	Args []string // Command line arguments for ARGC and ARGV$.
+	ExitCode int // Set by END or STOP, for the stand-alone interpreter.
+	LastSeed int64 // What RANDOMIZE last seeded the generator with.
+	ConsoleSize func () (int, int) // Columns and rows, if known better.
+	OnSleep func (d time.Duration) // Called instead of time.Sleep if set.
+	Now func () time.Time // The clock used by time functions.
+	
 	line_num int
 	crt_line int
 	stop bool
 	addr []int
-	stack list.List
+	labels map[string]int
+	typeHints map[byte]bool // Initial letters of integer variables.
+	boolean bool // Whether the last expression parsed was a truth value.
+	dryRun bool // Parse statements without carrying them out.
+	lastFrame time.Time // When the FRAME statement last ran.
+	scanner *bufio.Scanner // Shared by INPUT and the command loop.
+	scanned io.Reader // What the scanner was made for.
+	varOrder []string // Variable names in order of first assignment.
+	ordered map[string]bool // The names in varOrder, kept once each.
+	history []string // Recent lines typed at the command prompt.
+	procs map[string]func (args []Value) error
+	pure bool // Only the built-ins in Functions are available.
+	outputs []redirect // Where OUTPUT sent PRINT before, innermost last.
+	rng *rand.Rand // Used by RND; see Random.
+	loading []string // Files being loaded, the innermost INCLUDE last.
+	origin map[int]string // Which file each line was loaded from.
+	including int // How deep in INCLUDE statements loading is.
+	trace bool
+	profiling bool
+	profile map[int]int // How many times each line ran while profiling.
+	stack list.List // Of *Frame, innermost first.
+	steps int
+}
+
+// Something worth pointing out that isn't an error.
+type Warning struct {
+	Line int // Program line number, or 0 outside the program.
+	Message string
+}
+
+func (w Warning) String() string {
+	if w.Line == 0 { return "Warning: " + w.Message }
+	return "Warning in line " + strconv.Itoa(w.Line) + ": " + w.Message
+}
+
+// Record a warning against the current line, unless it's already there.
+func (ctx *Context) Warn(message string) {
+	ctx.WarnAt(ctx.line_num, message)
+}
+
+func (ctx *Context) WarnAt(ln int, message string) {
+	warning := Warning{ln, message}
+	for _, w := range ctx.Warnings {
+		if w == warning { return }
+	}
+	ctx.Warnings = append(ctx.Warnings, warning)
+}
+
+type redirect struct {
+	saved io.Writer
+	file *os.File
+}
+
+type AngleUnit int
+
+const (
+	Radians AngleUnit = iota
+	Degrees
+)
+
+type ProgramLine struct {
+	Number int
+	Text string
+}
+
+// The program as structured data, sorted by line number.
+func (ctx *Context) Lines() []ProgramLine {
+	lines := make([]ProgramLine, 0, len(ctx.Program))
+	for _, ln := range ctx.Program.LineNumbers() {
+		lines = append(lines, ProgramLine{ln, ctx.Program[ln]})
+	}
+	return lines
+}
+
+func (ctx *Context) SetLine(num int, text string) {
+	ctx.Program[num] = strings.TrimSpace(text)
+}
+
+func (ctx *Context) DeleteLine(num int) {
+	delete(ctx.Program, num)
+}
+
+// A SHA-256 digest of the program listing, for detecting changes.
+func (ctx *Context) ProgramHash() string {
+	hash := sha256.New()
+	for _, ln := range ctx.Program.LineNumbers() {
+		fmt.Fprintf(hash, "%d\t%s\n", ln, ctx.Program[ln])
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
+// Write the program as a JSON object mapping line numbers to their text.
+func (ctx *Context) ExportJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "\t")
+	return encoder.Encode(ctx.Program)
+}
+
+// Replace the program with one read in the format of ExportJSON.
+func (ctx *Context) ImportJSON(r io.Reader) error {
+	prg := make(Program)
+	if err := json.NewDecoder(r).Decode(&prg); err != nil {
+		return err
+	}
+	ctx.Program = prg
+	return nil
+}
+
+const DefaultMaxStackDepth = 1000
+const DefaultMaxLineNumber = 65529
+
+func NewContext() *Context {
+	return &Context{
+		Variables: make(Variables),
+		Program: make(Program),
+		In: Ins,
+		Out: Outs,
+		Err: Errs,
+		TraceOut: Errs,
+		Now: time.Now,
+		MaxStackDepth: DefaultMaxStackDepth,
+		MaxLineNumber: DefaultMaxLineNumber,
+		PrintFormat: "%g",
+	}
+}
+
+// Where a context made without NewContext reads and writes: the standard
+// streams, unless In, Out or Err say otherwise.
+func (ctx *Context) Stdin() io.Reader {
+	if ctx.In == nil { return Ins }
+	return ctx.In
+}
+
+func (ctx *Context) Stdout() io.Writer {
+	if ctx.Out == nil { return Outs }
+	return ctx.Out
+}
+
+func (ctx *Context) Stderr() io.Writer {
+	if ctx.Err == nil { return Errs }
+	return ctx.Err
+}
+
+type FrameKind int
+
+const (
+	GosubFrame FrameKind = iota
+	ForFrame
+	DoFrame
+)
+
+// An entry on the control stack, for a pending RETURN, NEXT or LOOP.
+type Frame struct {
+	Kind FrameKind
+	Line int // Index of the program line to go back to.
+	Var string // The FOR loop variable.
+	Limit float64
+	Step float64
+	Params []float64 // Passed by GOSUB, for PARAM.
+	Saved Variables // Values hidden by LOCAL, put back by RETURN.
+	Fresh []string // Names made by LOCAL, removed by RETURN.
 }
 
 type Builtin struct {
@@ -53,19 +246,42 @@ type Builtin struct {
 	Call func (args ...float64) float64
 }
 
+// Pure functions, the only ones EvalSafe allows. TIMER and RND depend on
+// the context, so they're in ContextFunctions instead.
 var Functions = map[string]Builtin {
-	"timer": {0, func (args ...float64) float64 {
-		return float64(time.Now().UnixNano()) / (1000 * 1000 * 1000)
-	}},
-	"rnd": {0, func (args ...float64) float64 {
-		return rand.Float64()
-	}},
 	"pi": {0, func (args ...float64) float64 {
 		return math.Pi
 	}},
+	"maxnum": {0, func (args ...float64) float64 {
+		return math.MaxFloat64
+	}},
+	"minnum": {0, func (args ...float64) float64 {
+		return math.SmallestNonzeroFloat64
+	}},
+	"inf": {0, func (args ...float64) float64 {
+		return math.Inf(1)
+	}},
+	// Truth values like comparisons give, -1 or 0.
+	"isnan": {1, func (args ...float64) float64 {
+		return Bool2float(math.IsNaN(args[0]))
+	}},
+	"isinf": {1, func (args ...float64) float64 {
+		return Bool2float(math.IsInf(args[0], 0))
+	}},
+	// The gap between 1 and the next larger number.
+	"eps": {0, func (args ...float64) float64 {
+		return math.Nextafter(1, 2) - 1
+	}},
+	// INT truncates toward zero, so INT(-2.5) is -2 but FLOOR(-2.5) is -3.
 	"int": {1, func (args ...float64) float64 {
 		return math.Trunc(args[0])
 	}},
+	"floor": {1, func (args ...float64) float64 {
+		return math.Floor(args[0])
+	}},
+	"ceil": {1, func (args ...float64) float64 {
+		return math.Ceil(args[0])
+	}},
 	"abs": {1, func (args ...float64) float64 {
 		return math.Abs(args[0])
 	}},
@@ -78,6 +294,9 @@ var Functions = map[string]Builtin {
 	"cos": {1, func (args ...float64) float64 {
 		return math.Cos(args[0])
 	}},
+	"tan": {1, func (args ...float64) float64 {
+		return math.Tan(args[0])
+	}},
 	"rad": {1, func (args ...float64) float64 {
 		return args[0] * (math.Pi / 180)
 	}},
@@ -90,8 +309,14 @@ var Functions = map[string]Builtin {
 	"max": {2, func (args ...float64) float64 {
 		return math.Max(args[0], args[1])
 	}},
+	// MOD truncates its operands to integers first; FMOD doesn't.
 	"mod": {2, func (args ...float64) float64 {
-		return float64(int64(args[0]) % int64(args[1]))
+		divisor := int64(args[1])
+		if divisor == 0 { return math.NaN() } // Like 0 / 0.
+		return float64(int64(args[0]) % divisor)
+	}},
+	"fmod": {2, func (args ...float64) float64 {
+		return math.Mod(args[0], args[1])
 	}},
 	"hypot2": {2, func (args ...float64) float64 {
 		return math.Sqrt(args[0] * args[0] + args[1] * args[1])
@@ -102,6 +327,15 @@ var Functions = map[string]Builtin {
 			args[1] * args[1] +
 			args[2] * args[2])
 	}},
+	"clamp": {3, func (args ...float64) float64 {
+		return math.Max(args[1], math.Min(args[0], args[2]))
+	}},
+	"lerp": {3, func (args ...float64) float64 {
+		return args[0] + (args[1] - args[0]) * args[2]
+	}},
+	"bool": {1, func (args ...float64) float64 {
+		if args[0] != 0 { return 1 } else { return 0 }
+	}},
 	"iif": {3, func (args ...float64) float64 {
 		if args[0] != 0 {
 			return args[1]
@@ -111,6 +345,160 @@ var Functions = map[string]Builtin {
 	}},
 }
 
+// Built-ins that need interpreter state, shadowing any in Functions.
+type ContextBuiltin struct {
+	Arity int
+	Call func (ctx *Context, args ...float64) float64
+}
+
+var ContextFunctions = map[string]ContextBuiltin {
+	"timer": {0, func (ctx *Context, args ...float64) float64 {
+		return float64(ctx.Clock().UnixNano()) / (1000 * 1000 * 1000)
+	}},
+	"sin": {1, func (ctx *Context, args ...float64) float64 {
+		return math.Sin(ctx.ToRadians(args[0]))
+	}},
+	"cos": {1, func (ctx *Context, args ...float64) float64 {
+		return math.Cos(ctx.ToRadians(args[0]))
+	}},
+	"tan": {1, func (ctx *Context, args ...float64) float64 {
+		return math.Tan(ctx.ToRadians(args[0]))
+	}},
+	// Direction of the vector (dx, dy), counterclockwise from the X axis.
+	"angle": {2, func (ctx *Context, args ...float64) float64 {
+		return ctx.FromRadians(math.Atan2(args[1], args[0]))
+	}},
+	"conwidth": {0, func (ctx *Context, args ...float64) float64 {
+		cols, _ := ctx.ConsoleDims()
+		return float64(cols)
+	}},
+	"argc": {0, func (ctx *Context, args ...float64) float64 {
+		return float64(len(ctx.Args))
+	}},
+	"rnd": {0, func (ctx *Context, args ...float64) float64 {
+		return ctx.Random().Float64()
+	}},
+	"gosubdepth": {0, func (ctx *Context, args ...float64) float64 {
+		return float64(ctx.CountFrames(GosubFrame))
+	}},
+	"loopdepth": {0, func (ctx *Context, args ...float64) float64 {
+		return float64(ctx.CountFrames(ForFrame) + ctx.CountFrames(DoFrame))
+	}},
+	"seed": {0, func (ctx *Context, args ...float64) float64 {
+		return float64(ctx.LastSeed)
+	}},
+	"conheight": {0, func (ctx *Context, args ...float64) float64 {
+		_, rows := ctx.ConsoleDims()
+		return float64(rows)
+	}},
+}
+
+func IsFunction(name string) bool {
+	if _, ok := ContextFunctions[name]; ok {
+		return true
+	} else if _, ok := TextFunctions[name]; ok {
+		return true
+	}
+	_, ok := Functions[name]
+	return ok
+}
+
+// Evaluate an untrusted expression with just the given variables and the
+// built-ins in Functions, away from any program, console or host state.
+func EvalSafe(expr string, vars Variables) (float64, error) {
+	ctx := &Context{
+		Line: expr,
+		Variables: make(Variables),
+		Program: make(Program),
+		In: strings.NewReader(""),
+		Out: io.Discard,
+		Err: io.Discard,
+		pure: true,
+	}
+	for name, value := range vars {
+		ctx.Variables[strings.ToLower(name)] = value
+	}
+	value, err := ctx.ParseExpression()
+	if err == nil && !ctx.MatchEol() {
+		err = errors.New("End of expression expected, found: " +
+			ctx.Line[ctx.Cursor:])
+	}
+	return value, err
+}
+
+func (ctx *Context) CallFunction(name string, args []float64) (float64, error) {
+	builtin, ok := ContextFunctions[name]
+	if !ok || ctx.pure {
+		return CallBuiltin(name, args)
+	} else if len(args) != builtin.Arity {
+		return 0, errors.New("Bad argument count in call to " + name)
+	} else if ctx.dryRun {
+		return 0, nil
+	} else {
+		return builtin.Call(ctx, args...), nil
+	}
+}
+
+// Terminal size in columns and rows. Without a ConsoleSize hook, the
+// terminal Out goes to is asked; failing that, $COLUMNS and $LINES are
+// used when Out is a terminal, else 80x24.
+func (ctx *Context) ConsoleDims() (int, int) {
+	if ctx.ConsoleSize != nil {
+		return ctx.ConsoleSize()
+	}
+	if file, ok := ctx.Stdout().(*os.File); ok {
+		info, err := file.Stat()
+		if err == nil && info.Mode() & os.ModeCharDevice != 0 {
+			if cols, rows, ok := TerminalSize(file); ok {
+				return cols, rows
+			}
+			cols, _ := strconv.Atoi(os.Getenv("COLUMNS"))
+			rows, _ := strconv.Atoi(os.Getenv("LINES"))
+			if cols > 0 && rows > 0 {
+				return cols, rows
+			}
+		}
+	}
+	return 80, 24
+}
+
+// Ask the terminal for its size with the TIOCGWINSZ ioctl.
+func TerminalSize(file *os.File) (int, int, bool) {
+	var size struct { Rows, Cols, Width, Height uint16 }
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(),
+		uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&size)))
+	if errno != 0 || size.Cols == 0 || size.Rows == 0 {
+		return 0, 0, false
+	}
+	return int(size.Cols), int(size.Rows), true
+}
+
+func (ctx *Context) Clock() time.Time {
+	if ctx.Now != nil {
+		return ctx.Now()
+	} else {
+		return time.Now()
+	}
+}
+
+// Convert an angle given in the current AngleMode.
+func (ctx *Context) ToRadians(angle float64) float64 {
+	if ctx.AngleMode == Degrees {
+		return angle * (math.Pi / 180)
+	} else {
+		return angle
+	}
+}
+
+// Convert an angle to the current AngleMode.
+func (ctx *Context) FromRadians(angle float64) float64 {
+	if ctx.AngleMode == Degrees {
+		return angle * (180 / math.Pi)
+	} else {
+		return angle
+	}
+}
+
 func CallBuiltin(name string, args []float64) (float64, error) {
 	builtin, ok := Functions[name]
 	if !ok {
@@ -122,11 +510,302 @@ func CallBuiltin(name string, args []float64) (float64, error) {
 	}
 }
 
+// Either a number or a string, as taken by text built-ins.
+type Value struct {
+	Num float64
+	Str string
+	IsStr bool
+}
+
+// Built-ins that take or return strings; the latter have names ending in $.
+// An arity of -1 means the function checks its own argument count.
+type TextBuiltin struct {
+	Arity int
+	Call func (ctx *Context, args []Value) (Value, error)
+}
+
+var TextFunctions = map[string]TextBuiltin {
+	"instr": {-1, func (ctx *Context, args []Value) (Value, error) {
+		start := 1
+		if len(args) == 3 {
+			if err := CheckArgs("instr", args, "nss"); err != nil {
+				return Value{}, err
+			}
+			start = int(args[0].Num)
+			args = args[1:]
+		} else if err := CheckArgs("instr", args, "ss"); err != nil {
+			return Value{}, err
+		}
+		haystack := []rune(args[0].Str)
+		if start < 1 {
+			return Value{}, errors.New("Bad start position in instr")
+		} else if start > len(haystack) {
+			return Value{Num: 0}, nil
+		}
+		tail := string(haystack[start - 1:])
+		if idx := strings.Index(tail, args[1].Str); idx > -1 {
+			idx = utf8.RuneCountInString(tail[:idx])
+			return Value{Num: float64(start + idx)}, nil
+		} else {
+			return Value{Num: 0}, nil
+		}
+	}},
+	"ucase$": {1, func (ctx *Context, args []Value) (Value, error) {
+		err := CheckArgs("ucase$", args, "s")
+		return Value{Str: strings.ToUpper(args[0].Str), IsStr: true}, err
+	}},
+	"lcase$": {1, func (ctx *Context, args []Value) (Value, error) {
+		err := CheckArgs("lcase$", args, "s")
+		return Value{Str: strings.ToLower(args[0].Str), IsStr: true}, err
+	}},
+	"trim$": {1, func (ctx *Context, args []Value) (Value, error) {
+		err := CheckArgs("trim$", args, "s")
+		return Value{Str: strings.TrimSpace(args[0].Str), IsStr: true}, err
+	}},
+	"ltrim$": {1, func (ctx *Context, args []Value) (Value, error) {
+		err := CheckArgs("ltrim$", args, "s")
+		text := strings.TrimLeftFunc(args[0].Str, unicode.IsSpace)
+		return Value{Str: text, IsStr: true}, err
+	}},
+	"rtrim$": {1, func (ctx *Context, args []Value) (Value, error) {
+		err := CheckArgs("rtrim$", args, "s")
+		text := strings.TrimRightFunc(args[0].Str, unicode.IsSpace)
+		return Value{Str: text, IsStr: true}, err
+	}},
+	"space$": {1, func (ctx *Context, args []Value) (Value, error) {
+		if err := CheckArgs("space$", args, "n"); err != nil {
+			return Value{}, err
+		}
+		count, err := RepeatCount("space$", args[0].Num)
+		if err != nil { return Value{}, err }
+		text := strings.Repeat(" ", count)
+		return Value{Str: text, IsStr: true}, nil
+	}},
+	"string$": {2, func (ctx *Context, args []Value) (Value, error) {
+		var char string
+		if args[1].IsStr {
+			if utf8.RuneCountInString(args[1].Str) != 1 {
+				return Value{}, errors.New(
+					"Single character expected in call to string$")
+			}
+			char = args[1].Str
+		} else {
+			char = string(rune(args[1].Num))
+		}
+		if args[0].IsStr {
+			return Value{}, errors.New("Type mismatch in call to string$")
+		}
+		count, err := RepeatCount("string$", args[0].Num)
+		if err != nil { return Value{}, err }
+		text := strings.Repeat(char, count)
+		return Value{Str: text, IsStr: true}, nil
+	}},
+	"asc": {1, func (ctx *Context, args []Value) (Value, error) {
+		if err := CheckArgs("asc", args, "s"); err != nil {
+			return Value{}, err
+		} else if len(args[0].Str) == 0 {
+			return Value{}, errors.New("Empty string in call to asc")
+		}
+		char, _ := utf8.DecodeRuneInString(args[0].Str)
+		return Value{Num: float64(char)}, nil
+	}},
+	// Always in ISO 8601 format: 2006-01-02 and 15:04:05 respectively.
+	"date$": {0, func (ctx *Context, args []Value) (Value, error) {
+		return Value{Str: ctx.Clock().Format("2006-01-02"), IsStr: true}, nil
+	}},
+	"time$": {0, func (ctx *Context, args []Value) (Value, error) {
+		return Value{Str: ctx.Clock().Format("15:04:05"), IsStr: true}, nil
+	}},
+	// Field n of the string split at each delimiter, counting from 1, or
+	// an empty string if there aren't that many.
+	"split$": {3, func (ctx *Context, args []Value) (Value, error) {
+		if err := CheckArgs("split$", args, "ssn"); err != nil {
+			return Value{}, err
+		}
+		fields := strings.Split(args[0].Str, args[1].Str)
+		n := int(args[2].Num)
+		if n < 1 || n > len(fields) {
+			return Value{IsStr: true}, nil
+		}
+		return Value{Str: fields[n - 1], IsStr: true}, nil
+	}},
+	"replace$": {3, func (ctx *Context, args []Value) (Value, error) {
+		if err := CheckArgs("replace$", args, "sss"); err != nil {
+			return Value{}, err
+		}
+		text := args[0].Str
+		if args[1].Str != "" { // Or each character would be surrounded.
+			text = strings.ReplaceAll(text, args[1].Str, args[2].Str)
+		}
+		return Value{Str: text, IsStr: true}, nil
+	}},
+	"like": {2, func (ctx *Context, args []Value) (Value, error) {
+		if err := CheckArgs("like", args, "ss"); err != nil {
+			return Value{}, err
+		}
+		return Value{Num: Bool2float(MatchWildcard(args[0].Str, args[1].Str))}, nil
+	}},
+	// Each % in the template is replaced by the next argument, formatted
+	// as PRINT would; %% stands for a % sign.
+	"format$": {-1, func (ctx *Context, args []Value) (Value, error) {
+		if len(args) == 0 || !args[0].IsStr {
+			return Value{}, errors.New("Type mismatch in call to format$")
+		}
+		template, rest := args[0].Str, args[1:]
+		text := ""
+		for i := 0; i < len(template); i++ {
+			if template[i] != '%' {
+				text += template[i:i + 1]
+			} else if i + 1 < len(template) && template[i + 1] == '%' {
+				text += "%"
+				i++
+			} else if len(rest) == 0 {
+				return Value{}, errors.New(
+					"Bad argument count in call to format$")
+			} else if rest[0].IsStr {
+				text += rest[0].Str
+				rest = rest[1:]
+			} else {
+				text += ctx.FormatNumber(rest[0].Num)
+				rest = rest[1:]
+			}
+		}
+		if len(rest) > 0 {
+			return Value{}, errors.New("Bad argument count in call to format$")
+		}
+		return Value{Str: text, IsStr: true}, nil
+	}},
+	"hex$": {1, func (ctx *Context, args []Value) (Value, error) {
+		return FormatRadix("hex$", args, 16)
+	}},
+	"oct$": {1, func (ctx *Context, args []Value) (Value, error) {
+		return FormatRadix("oct$", args, 8)
+	}},
+	"bin$": {1, func (ctx *Context, args []Value) (Value, error) {
+		return FormatRadix("bin$", args, 2)
+	}},
+	"param": {1, func (ctx *Context, args []Value) (Value, error) {
+		if err := CheckArgs("param", args, "n"); err != nil {
+			return Value{}, err
+		}
+		frame, ok := ctx.Subroutine()
+		if !ok { return Value{}, errors.New("PARAM outside subroutine") }
+		n := int(args[0].Num)
+		if n < 1 || n > len(frame.Params) {
+			return Value{}, errors.New("No such parameter: " + strconv.Itoa(n))
+		}
+		return Value{Num: frame.Params[n - 1]}, nil
+	}},
+	// Arguments are numbered from 1 to ARGC.
+	"argv$": {1, func (ctx *Context, args []Value) (Value, error) {
+		if err := CheckArgs("argv$", args, "n"); err != nil {
+			return Value{}, err
+		}
+		n := int(args[0].Num)
+		if n < 1 || n > len(ctx.Args) {
+			return Value{}, errors.New("No such argument: " + strconv.Itoa(n))
+		}
+		return Value{Str: ctx.Args[n - 1], IsStr: true}, nil
+	}},
+	"environ$": {1, func (ctx *Context, args []Value) (Value, error) {
+		if err := CheckArgs("environ$", args, "s"); err != nil {
+			return Value{}, err
+		} else if !ctx.AllowEnviron {
+			return Value{}, errors.New("ENVIRON$ is not allowed.")
+		}
+		return Value{Str: os.Getenv(args[0].Str), IsStr: true}, nil
+	}},
+}
+
+// Whether text matches pattern, in which * stands for any run of
+// characters and ? for any single character.
+func MatchWildcard(text, pattern string) bool {
+	t, p := []rune(text), []rune(pattern)
+	i, j := 0, 0
+	star, mark := -1, 0 // The last * seen, and where its match ends.
+	for i < len(t) {
+		if j < len(p) && (p[j] == '?' || p[j] == t[i]) {
+			i++
+			j++
+		} else if j < len(p) && p[j] == '*' {
+			star, mark = j, i
+			j++
+		} else if star >= 0 {
+			mark++
+			i, j = mark, star + 1
+		} else {
+			return false
+		}
+	}
+	for j < len(p) && p[j] == '*' { j++ }
+	return j == len(p)
+}
+
+// The digits of a number truncated to an integer, in upper case, with a
+// minus sign in front if it's negative: HEX$(-255) is "-FF".
+func FormatRadix(name string, args []Value, base int) (Value, error) {
+	if err := CheckArgs(name, args, "n"); err != nil {
+		return Value{}, err
+	}
+	text := strconv.FormatInt(int64(args[0].Num), base)
+	return Value{Str: strings.ToUpper(text), IsStr: true}, nil
+}
+
+// The longest string SPACE$ and STRING$ will make.
+const MaxRepeatCount = 1 << 24
+
+// Check the count given to SPACE$ or STRING$; it's truncated like INT.
+func RepeatCount(name string, count float64) (int, error) {
+	if math.IsNaN(count) {
+		return 0, errors.New("Bad count in call to " + name)
+	} else if count < 0 {
+		return 0, errors.New("Negative count in call to " + name)
+	} else if count > MaxRepeatCount {
+		return 0, errors.New("Count too large in call to " + name)
+	}
+	return int(count), nil
+}
+
+// Check the arguments to a text built-in against a pattern of kinds,
+// one letter per argument: 'n' for numbers, 's' for strings.
+func CheckArgs(name string, args []Value, kinds string) error {
+	if len(args) != len(kinds) {
+		return errors.New("Bad argument count in call to " + name)
+	}
+	for i, arg := range args {
+		if arg.IsStr != (kinds[i] == 's') {
+			return errors.New("Type mismatch in call to " + name)
+		}
+	}
+	return nil
+}
+
+func (ctx *Context) CallText(name string, args []Value) (Value, error) {
+	builtin, ok := TextFunctions[name]
+	if !ok || ctx.pure {
+		return Value{}, errors.New("No such function: " + name)
+	} else if builtin.Arity > -1 && len(args) != builtin.Arity {
+		return Value{}, errors.New("Bad argument count in call to " + name)
+	} else if ctx.dryRun { // The arguments may depend on lines not run.
+		return Value{IsStr: strings.HasSuffix(name, "$")}, nil
+	} else {
+		return builtin.Call(ctx, args)
+	}
+}
+
 // Parse (and run) the content of Context.Line, starting from Context.Cursor.
 func (ctx *Context) ParseLine() error {
 	if (ctx.MatchNumber()) {
 		value, err := strconv.Atoi(ctx.Token)
 		if err != nil { return err }
+		if _, ok := ctx.Program[value]; ok {
+			from, known := ctx.origin[value]
+			if known && len(ctx.loading) > 0 && from != ctx.LoadingFile() {
+				return errors.New("Line " + ctx.Token + " is already in " + from)
+			}
+			ctx.WarnAt(0, "Line " + ctx.Token + " replaced")
+		}
+		if len(ctx.loading) > 0 { ctx.origin[value] = ctx.LoadingFile() }
 		ctx.Program[value] = strings.TrimSpace(ctx.Line[ctx.Cursor:])
 		return nil
 	} else {
@@ -137,7 +816,11 @@ func (ctx *Context) ParseLine() error {
 // Parse/run the next statement from Context.Line, starting at Context.Cursor.
 func (ctx *Context) ParseStatement() error {
 	//ctx.SkipWhitespace()
-	if ctx.MatchKeyword() {
+	if ctx.MatchLabel() && ctx.MatchEol() {
+		return nil // Nothing else on the line.
+	} else if ctx.MatchAssignment() {
+		return ctx.ParseLet()
+	} else if ctx.MatchKeyword() {
 		return ctx.DispatchStatement()
 	} else {
 		return errors.New(
@@ -157,16 +840,205 @@ func (ctx *Context) DispatchStatement() error {
 		case "next": return ctx.ParseNext()
 		case "gosub": return ctx.ParseGosub()
 		case "return": return ctx.ParseReturn()
-		case "do": ctx.stack.PushFront(ctx.crt_line); return nil
-		case "loop": ctx.ParseLoop(); return nil
+		case "do": return ctx.ParseDo()
+		case "loop": return ctx.ParseLoop()
 		case "rem": ctx.Cursor = len(ctx.Line); return nil
 		case "randomize": return ctx.ParseRandomize();
-		case "stop": ctx.stop = true; return nil
-		case "end": ctx.crt_line = len(ctx.addr); return nil
+		case "wait": return ctx.ParseWait()
+		case "frame": return ctx.ParseFrame()
+		case "sleep": return ctx.ParseSleep()
+		case "option": return ctx.ParseOption()
+		case "defint": return ctx.ParseDeftype(true)
+		case "defdbl": return ctx.ParseDeftype(false)
+		case "undef": return ctx.ParseUndef()
+		case "tron": ctx.trace = true; return nil
+		case "troff": ctx.trace = false; return nil
+		case "stop": return ctx.ParseStop()
+		case "end": return ctx.ParseEnd()
+		case "select": return ctx.ParseSelect()
+		case "case": return ctx.ParseCase()
+		case "call": return ctx.ParseCall()
+		case "output": return ctx.ParseOutput()
+		case "shell": return ctx.ParseShell()
+		case "setenv": return ctx.ParseSetenv()
+		case "exit": return ctx.ParseExit()
+		case "iterate": return ctx.ParseIterate()
+		case "local": return ctx.ParseLocal()
+		case "include": return ctx.ParseInclude()
 		default: return errors.New("Unknown statement: " + ctx.Token)
 	}
 }
 
+// The statements known to DispatchStatement; keep the two in sync.
+var statements = []string{
+	"let", "if", "goto", "print", "input", "for", "next", "gosub",
+	"return", "do", "loop", "rem", "randomize", "wait", "frame", "sleep",
+	"option", "defint", "defdbl", "undef", "tron", "troff", "stop",
+	"end", "select", "case", "call", "output", "shell", "setenv", "exit",
+	"iterate", "local", "include",
+}
+
+func IsStatement(name string) bool {
+	for _, each := range statements {
+		if each == name { return true }
+	}
+	return false
+}
+
+// Statement keywords in alphabetical order, e.g. for tab completion.
+func Keywords() []string {
+	names := append([]string(nil), statements...)
+	sort.Strings(names)
+	return names
+}
+
+// One-line descriptions of statements and functions, for HELP.
+var Help = map[string]string{
+	"let": "LET name = expr: assign a variable",
+	"if": "IF expr THEN stmt [ELSE stmt]: run a statement conditionally",
+	"goto": "GOTO line: jump to a line number or label",
+	"print": "PRINT [AT(row, col)] items: write strings and numbers",
+	"input": "INPUT [\"prompt\",] name[%], ...: read numbers into variables",
+	"for": "FOR name = expr TO expr [STEP expr]: start a counted loop",
+	"next": "NEXT [name, ...]: end a FOR loop",
+	"gosub": "GOSUB line [(args)]: call a subroutine",
+	"return": "RETURN [expr]: leave a subroutine, setting RESULT",
+	"do": "DO: start a conditional loop",
+	"loop": "LOOP WHILE|UNTIL expr: end a DO loop",
+	"rem": "REM text: a comment",
+	"randomize": "RANDOMIZE [seed]: seed the random number generator",
+	"wait": "WAIT expr: pause until the condition is true",
+	"frame": "FRAME fps: pause until the next frame is due",
+	"sleep": "SLEEP seconds: pause the program",
+	"option": "OPTION ANGLE|TRUTH setting: change interpreter options",
+	"defint": "DEFINT letters: make variables integer by first letter",
+	"defdbl": "DEFDBL letters: make variables floating point again",
+	"undef": "UNDEF name, ...: forget variables",
+	"tron": "TRON: trace line numbers as they run",
+	"troff": "TROFF: stop tracing",
+	"stop": "STOP [code]: pause the program, CONTINUE resumes",
+	"end": "END [code]: finish the program, with an exit status",
+	"select": "SELECT CASE expr: start a multi-way branch",
+	"case": "CASE value, ... | IS op value | ELSE: a SELECT CASE branch",
+	"call": "CALL name[(args)]: run a procedure provided by the host",
+	"output": "OUTPUT [file$]: send PRINT output to a file, or back again",
+	"shell": "SHELL command$[, name]: run a command, keeping its exit code",
+	"setenv": "SETENV name$, value$: set an environment variable",
+	"exit": "EXIT FOR|DO: leave the innermost loop of that kind",
+	"iterate": "ITERATE: skip to the end of the innermost loop",
+	"local": "LOCAL name, ...: variables the subroutine keeps to itself",
+	"include": "INCLUDE \"file\": load the lines of another program file",
+	"abs": "ABS(x): absolute value",
+	"angle": "ANGLE(dx, dy): direction of a vector",
+	"argc": "ARGC: how many command line arguments there are",
+	"argv$": "ARGV$(n): command line argument n, counting from 1",
+	"asc": "ASC(s$): code of the first character",
+	"bin$": "BIN$(n): n in binary",
+	"bool": "BOOL(x): 1 if x is nonzero, else 0",
+	"ceil": "CEIL(x): round up",
+	"clamp": "CLAMP(x, lo, hi): limit x to a range",
+	"conheight": "CONHEIGHT: rows in the console",
+	"conwidth": "CONWIDTH: columns in the console",
+	"cos": "COS(x): cosine",
+	"date$": "DATE$: today's date",
+	"deg": "DEG(x): radians to degrees",
+	"eps": "EPS: the gap between 1 and the next larger number",
+	"environ$": "ENVIRON$(name$): the value of an environment variable",
+	"floor": "FLOOR(x): round down",
+	"format$": "FORMAT$(template$, ...): replace each % with an argument",
+	"fmod": "FMOD(x, y): floating-point remainder",
+	"gosubdepth": "GOSUBDEPTH: how many subroutines are running",
+	"hex$": "HEX$(n): n in hexadecimal",
+	"hypot2": "HYPOT2(x, y): length of a 2D vector",
+	"hypot3": "HYPOT3(x, y, z): length of a 3D vector",
+	"iif": "IIF(cond, a, b): a if cond is nonzero, else b",
+	"inf": "INF: positive infinity",
+	"isinf": "ISINF(x): true if x is infinite",
+	"isnan": "ISNAN(x): true if x is not a number",
+	"instr": "INSTR([start,] s$, t$): position of t$ in s$",
+	"int": "INT(x): truncate toward zero",
+	"lcase$": "LCASE$(s$): lower case",
+	"like": "LIKE(s$, pattern$): true if s$ matches, with * and ? wildcards",
+	"loopdepth": "LOOPDEPTH: how many FOR and DO loops are running",
+	"lerp": "LERP(a, b, t): interpolate between a and b",
+	"ltrim$": "LTRIM$(s$): strip leading spaces",
+	"max": "MAX(x, y): the larger value",
+	"maxnum": "MAXNUM: the largest number",
+	"min": "MIN(x, y): the smaller value",
+	"minnum": "MINNUM: the smallest positive number",
+	"mod": "MOD(x, y): integer remainder; NaN if y truncates to 0",
+	"oct$": "OCT$(n): n in octal",
+	"param": "PARAM(n): argument n passed by GOSUB, counting from 1",
+	"pi": "PI: the constant pi",
+	"rad": "RAD(x): degrees to radians",
+	"replace$": "REPLACE$(s$, find$, with$): replace every find$ in s$",
+	"rnd": "RND: random number in [0, 1)",
+	"rtrim$": "RTRIM$(s$): strip trailing spaces",
+	"seed": "SEED: what RANDOMIZE last seeded random numbers with",
+	"sin": "SIN(x): sine",
+	"space$": "SPACE$(n): n spaces",
+	"split$": "SPLIT$(s$, delim$, n): field n of s$, counting from 1",
+	"sqr": "SQR(x): square root",
+	"string$": "STRING$(n, s$): s$ repeated n times",
+	"tan": "TAN(x): tangent",
+	"time$": "TIME$: the time of day",
+	"timer": "TIMER: seconds since the epoch",
+	"trim$": "TRIM$(s$): strip surrounding spaces",
+	"ucase$": "UCASE$(s$): upper case",
+}
+
+// Print the description of one statement or function, or of all of them.
+func (ctx *Context) ParseHelp() error {
+	topic := strings.ToLower(strings.TrimSpace(ctx.Line[ctx.Cursor:]))
+	ctx.Cursor = len(ctx.Line)
+	if topic != "" {
+		text, ok := Help[topic]
+		if !ok { return errors.New("No help for: " + topic) }
+		fmt.Fprintln(ctx.Stdout(), text)
+		return nil
+	}
+	fmt.Fprintln(ctx.Stdout(), "Statements:")
+	for _, name := range Keywords() {
+		fmt.Fprintf(ctx.Stdout(), "  %s\n", Help[name])
+	}
+	fmt.Fprintln(ctx.Stdout(), "Functions:")
+	for _, name := range FunctionNames() {
+		fmt.Fprintf(ctx.Stdout(), "  %s\n", Help[name])
+	}
+	return nil
+}
+
+// How many arguments a built-in function takes, -1 if it varies.
+func FunctionArity(name string) (int, bool) {
+	name = strings.ToLower(name)
+	if builtin, ok := ContextFunctions[name]; ok {
+		return builtin.Arity, true
+	} else if builtin, ok := TextFunctions[name]; ok {
+		return builtin.Arity, true
+	} else if builtin, ok := Functions[name]; ok {
+		return builtin.Arity, true
+	}
+	return 0, false
+}
+
+// Names of all built-in functions in alphabetical order.
+func FunctionNames() []string {
+	names := make([]string, 0, len(Functions) + len(TextFunctions))
+	for name := range Functions {
+		names = append(names, name)
+	}
+	for name := range ContextFunctions {
+		if _, ok := Functions[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	for name := range TextFunctions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func (ctx *Context) ParseLet() error {
 	if !ctx.MatchVarname() {
 		return errors.New(
@@ -179,146 +1051,620 @@ func (ctx *Context) ParseLet() error {
 	}
 	value, err := ctx.ParseExpression()
 	if err != nil { return err }
-	ctx.Variables[var_name] = value
+	ctx.Assign(var_name, value)
 	return nil
 }
 
+// Store a variable, truncating it if DEFINT covers its initial letter.
+func (ctx *Context) Assign(name string, value float64) {
+	if ctx.dryRun { return }
+	if ctx.typeHints[name[0]] {
+		value = math.Trunc(value)
+	}
+	if !ctx.ordered[name] { // Even if UNDEF or LOCAL removed it since.
+		if ctx.ordered == nil { ctx.ordered = make(map[string]bool) }
+		ctx.varOrder = append(ctx.varOrder, name)
+		ctx.ordered[name] = true
+	}
+	ctx.Variables[name] = value
+}
+
+// Names of defined variables, in the order they were first assigned.
+func (ctx *Context) VarNames() []string {
+	names := make([]string, 0, len(ctx.Variables))
+	for _, name := range ctx.varOrder {
+		if _, ok := ctx.Variables[name]; ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// OUTPUT "file" sends PRINT output to a new file, and a bare OUTPUT goes
+// back to where it went before. Redirections can be nested.
+func (ctx *Context) ParseOutput() error {
+	fn, ok, err := ctx.ParseStringExpr()
+	if err != nil {
+		return err
+	} else if !ok && !ctx.MatchEol() {
+		return errors.New("String expected near " + ctx.Line[ctx.Cursor:])
+	} else if ctx.dryRun {
+		return nil
+	} else if !ok {
+		if len(ctx.outputs) == 0 {
+			return errors.New("OUTPUT is not redirected.")
+		}
+		return ctx.RestoreOutput(len(ctx.outputs) - 1)
+	}
+	file, err := os.Create(fn)
+	if err != nil { return err }
+	ctx.outputs = append(ctx.outputs, redirect{ctx.Stdout(), file})
+	ctx.Out = file
+	return nil
+}
+
+// SHELL "command", name runs the command with sh and puts its exit status
+// in the variable. Without one, a failing command is an error.
+func (ctx *Context) ParseShell() error {
+	command, ok, err := ctx.ParseStringExpr()
+	if err != nil {
+		return err
+	} else if !ok {
+		return errors.New("String expected near " + ctx.Line[ctx.Cursor:])
+	}
+	var_name := ""
+	if ctx.Match(",") {
+		if !ctx.MatchVarname() {
+			return errors.New(
+				"Variable expected near " + ctx.Line[ctx.Cursor:])
+		}
+		var_name = ctx.Token
+	}
+	if ctx.dryRun {
+		return nil
+	} else if !ctx.AllowShell {
+		return errors.New("SHELL is not allowed.")
+	}
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = ctx.Stdout()
+	cmd.Stderr = ctx.Stderr()
+	err = cmd.Run()
+	if exit, ok := err.(*exec.ExitError); ok && var_name != "" {
+		ctx.Assign(var_name, float64(exit.ExitCode()))
+		return nil
+	} else if err != nil {
+		return err
+	} else if var_name != "" {
+		ctx.Assign(var_name, 0)
+	}
+	return nil
+}
+
+func (ctx *Context) ParseSetenv() error {
+	name, ok, err := ctx.ParseStringExpr()
+	if err != nil || !ok {
+		if err == nil {
+			err = errors.New("String expected near " + ctx.Line[ctx.Cursor:])
+		}
+		return err
+	} else if !ctx.Match(",") {
+		return errors.New("',' expected near " + ctx.Line[ctx.Cursor:])
+	}
+	value, ok, err := ctx.ParseStringExpr()
+	if err != nil || !ok {
+		if err == nil {
+			err = errors.New("String expected near " + ctx.Line[ctx.Cursor:])
+		}
+		return err
+	} else if ctx.dryRun {
+		return nil
+	} else if !ctx.AllowEnviron {
+		return errors.New("SETENV is not allowed.")
+	}
+	return os.Setenv(name, value)
+}
+
+// Undo OUTPUT redirections until only depth of them are left.
+func (ctx *Context) RestoreOutput(depth int) error {
+	var err error
+	for len(ctx.outputs) > depth {
+		last := ctx.outputs[len(ctx.outputs) - 1]
+		ctx.outputs = ctx.outputs[:len(ctx.outputs) - 1]
+		ctx.Out = last.saved
+		if cerr := last.file.Close(); err == nil { err = cerr }
+	}
+	return err
+}
+
+// Make a host procedure available to CALL. Unlike functions, procedures
+// return no value but may fail, which stops the program.
+func (ctx *Context) RegisterProc(name string, fn func (args []float64) error) {
+	ctx.RegisterValueProc(name, func (args []Value) error {
+		nums := make([]float64, len(args))
+		for i, arg := range args {
+			if arg.IsStr {
+				return errors.New("Type mismatch in call to " +
+					strings.ToLower(name))
+			}
+			nums[i] = arg.Num
+		}
+		return fn(nums)
+	})
+}
+
+// Like RegisterProc, for procedures that also take string arguments.
+func (ctx *Context) RegisterValueProc(name string, fn func (args []Value) error) {
+	if ctx.procs == nil {
+		ctx.procs = make(map[string]func (args []Value) error)
+	}
+	ctx.procs[strings.ToLower(name)] = fn
+}
+
+func (ctx *Context) ParseCall() error {
+	if !ctx.MatchVarname() {
+		return errors.New(
+			"Procedure name expected near " + ctx.Line[ctx.Cursor:])
+	}
+	name := ctx.Token
+	args, err := ctx.ParseValueArgs()
+	if err != nil || ctx.dryRun {
+		return err
+	}
+	proc, ok := ctx.procs[name]
+	if !ok { return errors.New("Procedure not found: " + name) }
+	return proc(args)
+}
+
+// Forget the listed variables, so that reading them again is an error.
+func (ctx *Context) ParseUndef() error {
+	names, err := ctx.ParseVarlist()
+	if err != nil || ctx.dryRun { return err }
+	for _, name := range names {
+		delete(ctx.Variables, name)
+	}
+	return nil
+}
+
+func (ctx *Context) ClearVariables() {
+	ctx.Variables = make(Variables)
+	ctx.varOrder = nil
+	ctx.ordered = nil
+}
+
+// Handle DEFINT (integer) and DEFDBL (the default) for letter ranges.
+// Integer variables are truncated on every assignment, FOR and NEXT too.
+func (ctx *Context) ParseDeftype(integer bool) error {
+	for {
+		first, err := ctx.ParseInitial()
+		if err != nil { return err }
+		last := first
+		if ctx.Match("-") {
+			last, err = ctx.ParseInitial()
+			if err != nil { return err }
+		}
+		if ctx.typeHints == nil {
+			ctx.typeHints = make(map[byte]bool)
+		}
+		for c := first; c <= last; c++ {
+			if integer {
+				ctx.typeHints[c] = true
+			} else {
+				delete(ctx.typeHints, c)
+			}
+		}
+		if !ctx.Match(",") { return nil }
+	}
+}
+
+func (ctx *Context) ParseInitial() (byte, error) {
+	if !ctx.MatchVarname() || len(ctx.Token) != 1 ||
+		ctx.Token[0] < 'a' || ctx.Token[0] > 'z' {
+		return 0, errors.New(
+			"Letter expected near " + ctx.Line[ctx.Cursor:])
+	}
+	return ctx.Token[0], nil
+}
+
+// Either branch may be a line number, short for GOTO. An ELSE belongs to
+// the first IF on the line, so nested IFs can't have their own.
 func (ctx *Context) ParseIf() error {
 	condition, err := ctx.ParseExpression()
 	if err != nil {
 		return err
-	} else if ctx.MatchNocase("then") {
-		if condition != 0 {
-			ctx.SkipWhitespace()
-			return ctx.ParseStatement()
+	} else if !ctx.MatchNocase("then") {
+		return errors.New("IF without THEN.");
+	}
+	end := FindWord(ctx.Line, ctx.Cursor, "else")
+	if condition != 0 || ctx.dryRun {
+		err := ctx.ParseBranch(end)
+		if err != nil || !ctx.dryRun { return err }
+	}
+	if end < len(ctx.Line) {
+		ctx.Cursor = end + len("else")
+		return ctx.ParseBranch(len(ctx.Line))
+	}
+	ctx.Cursor = len(ctx.Line)
+	return nil
+}
+
+// Run the statement or line number from the cursor up to offset end.
+func (ctx *Context) ParseBranch(end int) error {
+	line := ctx.Line
+	ctx.Line = line[:end]
+	mark := ctx.Cursor
+	var err error
+	if ctx.MatchNumber() {
+		ctx.Cursor = mark
+		err = ctx.ParseGoto()
+	} else {
+		ctx.SkipWhitespace()
+		err = ctx.ParseStatement()
+	}
+	ctx.Line = line
+	if err == nil { ctx.Cursor = len(line) }
+	return err
+}
+
+// Offset of the first whole word kw in line outside string literals,
+// searching from offset from, or len(line) if there isn't one.
+func FindWord(line string, from int, kw string) int {
+	quoted := false
+	for i := from; i < len(line); i++ {
+		if line[i] == '"' {
+			quoted = !quoted
+		} else if quoted || i + len(kw) > len(line) {
+			continue
+		} else if !strings.EqualFold(line[i:i + len(kw)], kw) {
+			continue
+		} else if i > 0 && IsWordChar(line[i - 1]) {
+			continue
+		} else if i + len(kw) < len(line) && IsWordChar(line[i + len(kw)]) {
+			continue
 		} else {
-			ctx.Cursor = len(ctx.Line)
-			return nil
+			return i
 		}
-	} else {
-		return errors.New("IF without THEN.");
 	}
+	return len(line)
+}
+
+func IsWordChar(c byte) bool {
+	return c == '_' || c == '$' || unicode.IsLetter(rune(c)) ||
+		unicode.IsDigit(rune(c))
 }
 
 func (ctx *Context) ParseGoto() error {
 	if ctx.addr == nil { return errors.New("Program not running.") }
+	idx, err := ctx.ParseTarget()
+	if err != nil || ctx.dryRun { return err }
+	ctx.crt_line = idx
+	return nil
+}
+
+// Parse a GOTO or GOSUB destination, returning its index in the program.
+// The destination can be a label or an expression giving a line number.
+func (ctx *Context) ParseTarget() (int, error) {
+	mark := ctx.Cursor
+	if ctx.dryRun {
+		_, err := ctx.ParseArithmetic() // Labels will parse as variables.
+		return -1, err
+	} else if ctx.MatchVarname() {
+		name := ctx.Token
+		if ln, ok := ctx.labels[name]; ok {
+			// The label may be on a line added since RUN.
+			if idx := IndexOf(ln, ctx.addr); idx > -1 { return idx, nil }
+			return -1, errors.New("Label not found: " + name)
+		} else if _, ok := ctx.Variables[name]; ok {
+			ctx.Cursor = mark
+		} else if IsFunction(name) {
+			ctx.Cursor = mark
+		} else {
+			return -1, errors.New("Label not found: " + name)
+		}
+	}
 	ln, err := ctx.ParseArithmetic()
+	ln = math.Round(ln) // Computed targets go to the nearest line number.
 	if err != nil {
-		return err
-	} else if idx := IndexOf(int(ln), ctx.addr); idx > -1 {
-		ctx.crt_line = idx
-		return nil
-	} else {
-		return errors.New("Line not found: " + fmt.Sprintf("%d", ln))
+		return -1, err
+	} else if ln < 0 {
+		return -1, errors.New(
+			"Negative line number: " + fmt.Sprintf("%g", ln))
+	} else if ln > MaxExactInteger {
+		ctx.Warn("Line number " + fmt.Sprintf("%g", ln) +
+			" is too large to be exact")
+	}
+	if ln < math.MaxInt64 {
+		if idx := IndexOf(int(ln), ctx.addr); idx > -1 { return idx, nil }
 	}
+	return -1, errors.New("Line not found: " + fmt.Sprintf("%g", ln))
 }
 
+// Above this, not every integer can be held in a variable.
+const MaxExactInteger = 1 << 53
+
 func (ctx *Context) ParsePrint() error {
+	mark := ctx.Cursor
+	if ctx.MatchNocase("at") {
+		args, err := ctx.ParseArgs()
+		if err != nil {
+			return err
+		} else if len(args) == 0 {
+			ctx.Cursor = mark // Just a variable named "at".
+		} else if len(args) != 2 {
+			return errors.New("AT expects a row and a column")
+		} else {
+			if !ctx.dryRun {
+				ctx.MoveCursor(int(args[0]), int(args[1]))
+			}
+			if ctx.Match(";") {
+				if ctx.MatchEol() { return nil } // Stay at the position.
+			} else if !ctx.MatchEol() {
+				return errors.New(
+					"';' expected near " + ctx.Line[ctx.Cursor:])
+			}
+		}
+	}
 	if ctx.MatchEol() {
-		fmt.Fprintln(Outs)
+		if !ctx.dryRun { fmt.Fprintln(ctx.Stdout()) }
 		return nil
 	}
 	value, err := ctx.ParsePrintable()
 	if err != nil { return err }
-	for ctx.Match(",") {
-		val, err := ctx.ParsePrintable()
+	newline := true
+	for !ctx.MatchEol() {
+		spaced := false
+		sep := ""
+		if ctx.Match(";") {
+			if ctx.MatchEol() { newline = false; break }
+		} else if ctx.Match(",") {
+			sep = ctx.CommaSep
+		} else {
+			// Items side by side, as in PRINT A B C, are spaced apart
+			// by the sign position of numbers, blank unless negative.
+			spaced = true
+		}
+		val, numeric, err := ctx.ParsePrintItem()
 		if err != nil { return err }
-		value += val
+		if spaced && numeric && !strings.HasPrefix(val, "-") {
+			val = " " + val
+		}
+		value += sep + val
 	}
-	if ctx.Match(";") {
-		fmt.Fprint(Outs, value)
+	if ctx.dryRun {
+		return nil
+	} else if !newline {
+		fmt.Fprint(ctx.Stdout(), value)
 	} else {
-		fmt.Fprintln(Outs, value)
+		fmt.Fprintln(ctx.Stdout(), value)
+	}
+	return nil
+}
+
+// Position the terminal cursor using an ANSI escape; both are 1-based.
+func (ctx *Context) MoveCursor(row, col int) {
+	fmt.Fprintf(ctx.Stdout(), "\x1b[%d;%dH", row, col)
+}
+
+func (ctx *Context) ParsePrintable() (string, error) {
+	text, _, err := ctx.ParsePrintItem()
+	return text, err
+}
+
+// Like ParsePrintable, but also tell whether the item was a number.
+func (ctx *Context) ParsePrintItem() (string, bool, error) {
+	text, ok, err := ctx.ParseStringExpr()
+	if err != nil {
+		return "", false, err
+	} else if ok {
+		return text, false, nil
+	} else {
+		value, err := ctx.ParseExpression()
+		if ctx.TruthNames && ctx.boolean {
+			if value != 0 {
+				return "TRUE", false, err
+			} else {
+				return "FALSE", false, err
+			}
+		}
+		return ctx.FormatNumber(value), true, err
+	}
+}
+
+func (ctx *Context) FormatNumber(value float64) string {
+	if ctx.PrintFormat == "" {
+		return fmt.Sprintf("%g", value)
+	} else {
+		return fmt.Sprintf(ctx.PrintFormat, value)
+	}
+}
+
+// Parse a string literal or a call to a string function, if present.
+func (ctx *Context) ParseStringExpr() (string, bool, error) {
+	text, ok, err := ctx.ParseStringLiteral()
+	if ok || err != nil { return text, ok, err }
+	mark := ctx.Cursor
+	if !ctx.MatchVarname() || !ctx.Match("$") {
+		ctx.Cursor = mark
+		return "", false, nil
+	}
+	name := ctx.Token + "$"
+	args, err := ctx.ParseValueArgs()
+	if err != nil { return "", false, err }
+	result, err := ctx.CallText(name, args)
+	return result.Str, true, err
+}
+
+func (ctx *Context) ParseValue() (Value, error) {
+	text, ok, err := ctx.ParseStringExpr()
+	if err != nil {
+		return Value{}, err
+	} else if ok {
+		return Value{Str: text, IsStr: true}, nil
+	} else {
+		num, err := ctx.ParseExpression()
+		return Value{Num: num}, err
+	}
+}
+
+func (ctx *Context) ParseValueArgs() ([]Value, error) {
+	args := make([]Value, 0, 3)
+	if !ctx.Match("(") || ctx.Match(")") {
+		return args, nil
+	}
+	for {
+		value, err := ctx.ParseValue()
+		if err != nil {
+			return args, err
+		}
+		args = append(args, value)
+		if ctx.Match(")") {
+			return args, nil
+		} else if !ctx.Match(",") {
+			return args, errors.New(
+				"Missing ')' near " + ctx.Line[ctx.Cursor:])
+		}
 	}
-	return nil
 }
 
-func (ctx *Context) ParsePrintable() (string, error) {
-	value, err := ctx.MatchedString()
-	if err != nil {
-		return "", err
-	} else if value {
-		return ctx.Token, nil
-	} else {
-		value2, err := ctx.ParseExpression()
-		return fmt.Sprintf("%g", value2), err
-	}
+// Like ParseStringLiteral, but leaves the string in Context.Token.
+func (ctx *Context) MatchedString() (bool, error) {
+	text, ok, err := ctx.ParseStringLiteral()
+	if ok { ctx.Token = text }
+	return ok, err
 }
 
-func (ctx *Context) MatchedString() (bool, error) {
+// Parse a double-quoted string, returning its value without the quotes.
+func (ctx *Context) ParseStringLiteral() (string, bool, error) {
 	ctx.SkipWhitespace()
 
 	if ctx.Cursor >= len(ctx.Line) || ctx.Line[ctx.Cursor] != '"' {
-		return false, nil
+		return "", false, nil
 	}
 		
 	mark := ctx.Cursor
 	ctx.Cursor++ // Skip the opening double quote.
 	if ctx.Cursor >= len(ctx.Line) {
-		return false, errors.New("Unclosed string")
+		return "", false, errors.New("Unclosed string")
 	}
 	for ctx.Line[ctx.Cursor] != '"' {
 		ctx.Cursor++
 		if ctx.Cursor >= len(ctx.Line) {
-			return false, errors.New("Unclosed string")
+			return "", false, errors.New("Unclosed string")
 		}
 	}
 	ctx.Cursor++ // Skip the closing double quote.
 	
-	// Save string value without the double quotes.
-	ctx.Token = ctx.Line[mark + 1:ctx.Cursor - 1]
-	return true, nil
+	return ctx.Line[mark + 1:ctx.Cursor - 1], true, nil
+}
+
+// A variable for INPUT to fill, which may only take whole numbers.
+type InputVar struct {
+	Name string
+	Integer bool
 }
 
+// INPUT asks for the values again, after "?Redo from start", if any of
+// them isn't a number. A name followed by %, as in INPUT n%, only takes
+// whole numbers; the variable is still called n. Values can be typed over
+// several lines, and any still missing at the end of the input are 0.
 func (ctx *Context) ParseInput() error {
-	var prompt string
-	ok, err := ctx.MatchedString()
+	prompt, ok, err := ctx.ParseStringLiteral()
 	if err != nil {
 		return err
 	} else if ok {
-		prompt = ctx.Token
-		if !ctx.Match(",") {
+		if !ctx.Match(",") && !ctx.Match(";") {
 			return errors.New(
 				"Comma expected near " + ctx.Line[ctx.Cursor:])
 		}
 	}
 	
-	input_vars, err := ctx.ParseVarlist()
-	if err != nil { return err }
-	fmt.Fprint(Outs, prompt)
-	var data []string
-	scanner := bufio.NewScanner(os.Stdin)
-	if scanner.Scan() {
-		data = strings.Split(scanner.Text(), ",")
-	} else if err := scanner.Err(); err != nil {
-		return err
-	} else {
-		data = make([]string, 0)
+	input_vars, err := ctx.ParseInputVars()
+	if err != nil || ctx.dryRun { return err }
+	for retries := 0; ; retries++ {
+		if ctx.MaxInputRetries > 0 && retries > ctx.MaxInputRetries {
+			return errors.New("Too many retries for INPUT")
+		}
+		fmt.Fprint(ctx.Stdout(), prompt)
+		data, err := ctx.ReadInputData(len(input_vars))
+		if err != nil { return err }
+		values, valid := ParseInputValues(data, input_vars)
+		if valid {
+			for i, v := range input_vars {
+				ctx.Assign(v.Name, values[i])
+			}
+			return nil
+		}
+		fmt.Fprintln(ctx.Stdout(), "?Redo from start")
 	}
+}
 
-	for i, varname := range input_vars {
-		if i < len(data) {
-			data[i] = strings.TrimSpace(data[i])
-			if len(data[i]) == 0 {
-				ctx.Variables[varname] = 0
-			} else {
-				value, err := strconv.ParseFloat(data[i], 64)
-				if err != nil {
-					fmt.Fprintf(Errs,
-						"Can't parse number: " +
-						data[i])
-					fmt.Fprintf(Errs,
-						" Maybe you forgot a comma?\n")
-					ctx.Variables[varname] = 0
-				} else {
-					ctx.Variables[varname] = value
-				}
-			}
-		} else {
-			ctx.Variables[varname] = 0
+// Read comma-separated values until there are count of them, asking for
+// more with "?? ". There may be fewer at the end of the input.
+func (ctx *Context) ReadInputData(count int) ([]string, error) {
+	data := make([]string, 0, count)
+	for {
+		line, ok, err := ctx.ReadLine()
+		if err != nil || !ok { return data, err }
+		data = append(data, strings.Split(line, ",")...)
+		if len(data) >= count { return data, nil }
+		fmt.Fprint(ctx.Stdout(), "?? ")
+	}
+}
+
+func (ctx *Context) ParseInputVars() ([]InputVar, error) {
+	input_vars := make([]InputVar, 0)
+	for {
+		if !ctx.MatchVarname() {
+			return input_vars, errors.New(
+				"Variable expected near " + ctx.Line[ctx.Cursor:])
 		}
+		input_vars = append(input_vars, InputVar{ctx.Token, ctx.Match("%")})
+		if !ctx.Match(",") { return input_vars, nil }
+	}
+}
+
+// Convert the text typed for each variable, or tell that some is invalid.
+func ParseInputValues(data []string, input_vars []InputVar) ([]float64, bool) {
+	values := make([]float64, len(input_vars))
+	for i, v := range input_vars {
+		if i >= len(data) { break }
+		text := strings.TrimSpace(data[i])
+		if len(text) == 0 { continue }
+		value, err := strconv.ParseFloat(text, 64)
+		if err != nil || v.Integer && value != math.Trunc(value) {
+			return values, false
+		}
+		values[i] = value
+	}
+	return values, true
+}
+
+// Read a line of text from In; false means there was nothing left.
+func (ctx *Context) ReadLine() (string, bool, error) {
+	if ctx.scanner == nil || ctx.scanned != ctx.Stdin() {
+		ctx.scanner = bufio.NewScanner(ctx.Stdin())
+		ctx.scanned = ctx.Stdin()
+	}
+	if ctx.scanner.Scan() {
+		return ctx.scanner.Text(), true, nil
+	} else {
+		return "", false, ctx.scanner.Err()
 	}
-	return nil
+}
+
+const HistorySize = 100
+
+// Remember a line typed at the command prompt, forgetting the oldest.
+func (ctx *Context) Remember(line string) {
+	if strings.TrimSpace(line) == "" { return }
+	ctx.history = append(ctx.history, line)
+	if len(ctx.history) > HistorySize {
+		ctx.history = ctx.history[len(ctx.history) - HistorySize:]
+	}
+}
+
+// Recent command lines, oldest first.
+func (ctx *Context) History() []string {
+	return append([]string(nil), ctx.history...)
 }
 
 func (ctx *Context) ParseVarlist() ([]string, error) {
@@ -352,7 +1698,8 @@ func (ctx *Context) ParseFor() error {
 	
 	init, err := ctx.ParseArithmetic()
 	if err != nil { return err }
-	ctx.Variables[var_name] = init
+	if ctx.typeHints[var_name[0]] { init = math.Trunc(init) } // DEFINT
+	ctx.Assign(var_name, init)
 	
 	if !ctx.MatchNocase("to") {
 		return errors.New(
@@ -366,108 +1713,639 @@ func (ctx *Context) ParseFor() error {
 	if ctx.MatchNocase("step") {
 		step, err = ctx.ParseArithmetic()
 		if err != nil { return err }
-		if step == 0 { return errors.New("Infinite loop") }
+		if ctx.typeHints[var_name[0]] { step = math.Trunc(step) } // DEFINT
+		if step == 0 && !ctx.dryRun { return errors.New("Infinite loop") }
 	} else {
 		step = 1
 	}
-
-	ctx.stack.PushFront(ctx.crt_line)
-	ctx.stack.PushFront(limit);
-	ctx.stack.PushFront(step);
 	
+	// Like in classic BASIC, the body may run zero times.
+	if ctx.dryRun { return nil }
+	ctx.DropLoop(var_name)
+	if (step > 0 && init > limit) || (step < 0 && init < limit) {
+		return ctx.SkipLoop()
+	}
+
+	if err := ctx.CheckStack(); err != nil { return err }
+	ctx.stack.PushFront(&Frame{
+		Kind: ForFrame,
+		Line: ctx.crt_line,
+		Var: var_name,
+		Limit: limit,
+		Step: step,
+	})
+	return nil
+}
+
+// A FOR loop entered again, say after a GOTO out of it, replaces the old
+// loop on the same variable, and any loops left open inside that one.
+func (ctx *Context) DropLoop(var_name string) {
+	for e := ctx.stack.Front(); e != nil; e = e.Next() {
+		frame := e.Value.(*Frame)
+		if frame.Kind == GosubFrame {
+			return
+		} else if frame.Kind == ForFrame && frame.Var == var_name {
+			for ctx.stack.Front() != e {
+				ctx.stack.Remove(ctx.stack.Front())
+			}
+			ctx.stack.Remove(e)
+			return
+		}
+	}
+}
+
+// Resume execution after the NEXT matching the FOR on the current line.
+func (ctx *Context) SkipLoop() error {
+	if ctx.addr == nil { return nil } // Nothing to skip in immediate mode.
+	idx, pos, ok := ctx.FindLoopEnd(1)
+	if !ok { return errors.New("FOR without NEXT.") }
+	return ctx.ResumeNext(idx, pos + 1)
+}
+
+// Go on after line idx as if it ran, when it's a NEXT, stepping only
+// the loops it names from position from onwards.
+func (ctx *Context) ResumeNext(idx, from int) error {
+	ctx.crt_line = idx + 1
+	names := NextNames(ctx.Program[ctx.addr[idx]])
+	for ; from < len(names); from++ {
+		done, err := ctx.StepLoop(names[from])
+		if err != nil || !done { return err }
+	}
+	return nil
+}
+
+// The loop variables a NEXT statement names, or "" for a bare NEXT.
+func NextNames(text string) []string {
+	scan := Context{Line: text}
+	scan.MatchLabel()
+	scan.SkipWhitespace()
+	if !scan.MatchKeyword() || scan.Token != "next" {
+		return nil
+	} else if !scan.MatchVarname() {
+		return []string{""}
+	}
+	names := []string{scan.Token}
+	for scan.Match(",") && scan.MatchVarname() {
+		names = append(names, scan.Token)
+	}
+	return names
+}
+
+// Index of the line that closes the given number of loops open at the
+// current line, passing over any loops opened and closed on the way.
+// Also gives the position of the last of them among that line's loop
+// ends, as NEXT j, i closes two loops.
+func (ctx *Context) FindLoopEnd(loops int) (int, int, bool) {
+	depth := 0
+	for i := ctx.crt_line; i < len(ctx.addr); i++ {
+		text := ctx.Program[ctx.addr[i]]
+		closes := 0
+		switch LeadingKeyword(text) {
+			case "for", "do": depth++
+			// NEXT j, i closes as many loops as it has names.
+			case "next": closes = strings.Count(text, ",") + 1
+			case "loop": closes = 1
+		}
+		for pos := 0; pos < closes; pos++ {
+			if depth > 0 {
+				depth--
+			} else if loops--; loops == 0 {
+				return i, pos, true
+			}
+		}
+	}
+	return -1, 0, false
+}
+
+// ITERATE skips the rest of the innermost loop's body, going straight to
+// its NEXT or LOOP.
+func (ctx *Context) ParseIterate() error {
+	if ctx.dryRun { return nil }
+	if ctx.addr == nil { return errors.New("Program not running.") }
+	if _, ok := ctx.TopFrame(GosubFrame); ok || ctx.stack.Len() == 0 {
+		return errors.New("ITERATE outside loop")
+	}
+	idx, pos, ok := ctx.FindLoopEnd(1)
+	if !ok { return errors.New("Loop has no end") }
+	if pos > 0 { return ctx.ResumeNext(idx, pos) } // Past NEXT j in NEXT j, i.
+	ctx.crt_line = idx
 	return nil
 }
 
+// EXIT FOR and EXIT DO leave the innermost loop of that kind, with any
+// loops inside it, going on after the NEXT or LOOP that ends it.
+func (ctx *Context) ParseExit() error {
+	var kind FrameKind
+	if ctx.MatchNocase("for") {
+		kind = ForFrame
+	} else if ctx.MatchNocase("do") {
+		kind = DoFrame
+	} else {
+		return errors.New("FOR or DO expected near " + ctx.Line[ctx.Cursor:])
+	}
+	name := strings.ToUpper(ctx.Token)
+	if ctx.dryRun { return nil }
+	if ctx.addr == nil { return errors.New("Program not running.") }
+	loops := 0
+	for e := ctx.stack.Front(); ; e = e.Next() {
+		if e == nil || e.Value.(*Frame).Kind == GosubFrame {
+			return errors.New("EXIT " + name + " outside " + name + " loop")
+		}
+		loops++
+		if e.Value.(*Frame).Kind == kind { break }
+	}
+	idx, pos, ok := ctx.FindLoopEnd(loops)
+	if !ok { return errors.New(name + " loop has no end") }
+	for ; loops > 0; loops-- {
+		ctx.stack.Remove(ctx.stack.Front())
+	}
+	return ctx.ResumeNext(idx, pos + 1)
+}
+
+// NEXT without a variable name applies to the innermost FOR loop;
+// NEXT j, i is the same as NEXT j followed by NEXT i.
 func (ctx *Context) ParseNext() error {
-	if !ctx.MatchVarname() {
+	var names []string
+	if ctx.MatchVarname() {
+		names = append(names, ctx.Token)
+		for ctx.Match(",") {
+			if !ctx.MatchVarname() {
+				return errors.New(
+					"Variable expected near " + ctx.Line[ctx.Cursor:])
+			}
+			names = append(names, ctx.Token)
+		}
+	} else {
+		names = append(names, "")
+	}
+	if !ctx.MatchEol() {
 		return errors.New(
 			"Variable expected near " + ctx.Line[ctx.Cursor:])
 	}
-	var_name := ctx.Token
-	_, ok := ctx.Variables[var_name]
-	if !ok { return errors.New("Variable not found: " + var_name) }
+	if ctx.dryRun { return nil }
+	for _, var_name := range names {
+		done, err := ctx.StepLoop(var_name)
+		if err != nil || !done { return err }
+	}
+	return nil
+}
+
+// Advance the innermost FOR loop, checking it runs over var_name if that
+// is given. Either jumps back to the loop body or drops the finished loop.
+func (ctx *Context) StepLoop(var_name string) (bool, error) {
+	frame, ok := ctx.TopFrame(ForFrame)
+	if !ok {
+		return false, errors.New("NEXT without FOR.")
+	} else if var_name != "" && var_name != frame.Var {
+		return false, errors.New(
+			"NEXT " + var_name + " doesn't match FOR " + frame.Var)
+	}
+	value, ok := ctx.Variables[frame.Var]
+	if !ok { return false, errors.New("Variable not found: " + frame.Var) }
 	
-	step := ctx.stack.Front().Value.(float64)
-	limit := ctx.stack.Front().Next().Value.(float64)
-	ctx.Variables[var_name] += step
+	ctx.Assign(frame.Var, value + frame.Step)
+	value = ctx.Variables[frame.Var]
 	
 	var done bool
-	if step > 0 {
-		done = ctx.Variables[var_name] > limit
-	} else if step < 0 {
-		done = ctx.Variables[var_name] < limit
+	if frame.Step > 0 {
+		done = value > frame.Limit
+	} else if frame.Step < 0 {
+		done = value < frame.Limit
 	} else {
-		return errors.New("Infinite loop")
+		return false, errors.New("Infinite loop")
 	}
 	if done {
 		ctx.stack.Remove(ctx.stack.Front())
-		ctx.stack.Remove(ctx.stack.Front())
-		ctx.stack.Remove(ctx.stack.Front())
 	} else {
-		ctx.crt_line = ctx.stack.Front().Next().Next().Value.(int)
+		ctx.crt_line = frame.Line
 	}
-	return nil
+	return done, nil
+}
+
+// The innermost frame on the control stack, and whether it's of that kind.
+func (ctx *Context) TopFrame(kind FrameKind) (*Frame, bool) {
+	if ctx.stack.Len() == 0 {
+		return nil, false
+	}
+	frame := ctx.stack.Front().Value.(*Frame)
+	return frame, frame.Kind == kind
 }
 
+// GOSUB line (args) passes the values of the arguments, which the
+// subroutine can read with PARAM(1), PARAM(2) and so on.
 func (ctx *Context) ParseGosub() error {
-	ln, err := ctx.ParseArithmetic()
-	if err != nil {
-		return err
-	} else if idx := IndexOf(int(ln), ctx.addr); idx > -1 {
-		ctx.stack.PushFront(ctx.crt_line)
-		ctx.crt_line = idx
-		return nil
-	} else {
-		return errors.New("Line not found: " + fmt.Sprintf("%d", ln))
+	idx, err := ctx.ParseTarget()
+	if err != nil { return err }
+	params, err := ctx.ParseArgs()
+	if err != nil || ctx.dryRun { return err }
+	if err := ctx.CheckStack(); err != nil { return err }
+	ctx.stack.PushFront(&Frame{
+		Kind: GosubFrame,
+		Line: ctx.crt_line,
+		Params: params,
+	})
+	ctx.crt_line = idx
+	return nil
+}
+
+// The lines of the GOSUBs that led to the current line, innermost first.
+func (ctx *Context) CallChain() []int {
+	lines := make([]int, 0)
+	for e := ctx.stack.Front(); e != nil; e = e.Next() {
+		frame := e.Value.(*Frame)
+		if ln, ok := ctx.FrameLine(frame); ok && frame.Kind == GosubFrame {
+			lines = append(lines, ln)
+		}
+	}
+	return lines
+}
+
+func (ctx *Context) CountFrames(kind FrameKind) int {
+	count := 0
+	for e := ctx.stack.Front(); e != nil; e = e.Next() {
+		if e.Value.(*Frame).Kind == kind { count++ }
+	}
+	return count
+}
+
+// The number of the line with the GOSUB, FOR or DO that made the frame.
+func (ctx *Context) FrameLine(frame *Frame) (int, bool) {
+	if frame.Line < 1 || frame.Line > len(ctx.addr) {
+		return 0, false // Made in immediate mode.
+	}
+	return ctx.addr[frame.Line - 1], true
+}
+
+// List the control stack, innermost first, e.g. after a STOP.
+func (ctx *Context) StackReport(w io.Writer) {
+	for e := ctx.stack.Front(); e != nil; e = e.Next() {
+		frame := e.Value.(*Frame)
+		where := "immediate mode"
+		if ln, ok := ctx.FrameLine(frame); ok {
+			where = "line " + strconv.Itoa(ln)
+		}
+		switch frame.Kind {
+			case GosubFrame:
+				fmt.Fprintf(w, "GOSUB in %s", where)
+				if len(frame.Params) > 0 {
+					fmt.Fprintf(w, " with %v", frame.Params)
+				}
+				fmt.Fprintln(w)
+			case ForFrame:
+				fmt.Fprintf(w, "FOR %s = %g TO %g STEP %g in %s\n",
+					frame.Var, ctx.Variables[frame.Var],
+					frame.Limit, frame.Step, where)
+			case DoFrame:
+				fmt.Fprintf(w, "DO in %s\n", where)
+		}
+	}
+}
+
+// The call chain for an error message, e.g. " (called from lines 40, 20)".
+func (ctx *Context) Traceback() string {
+	lines := ctx.CallChain()
+	if len(lines) == 0 { return "" }
+	text := make([]string, len(lines))
+	for i, ln := range lines {
+		text[i] = strconv.Itoa(ln)
+	}
+	if len(lines) == 1 { return " (called from line " + text[0] + ")" }
+	return " (called from lines " + strings.Join(text, ", ") + ")"
+}
+
+// The frame of the subroutine that's running, if any.
+func (ctx *Context) Subroutine() (*Frame, bool) {
+	for e := ctx.stack.Front(); e != nil; e = e.Next() {
+		if frame := e.Value.(*Frame); frame.Kind == GosubFrame {
+			return frame, true
+		}
+	}
+	return nil, false
+}
+
+// LOCAL a, b sets the variables to 0 until the subroutine returns, when
+// they get back the values they had before, or go away if they had none.
+func (ctx *Context) ParseLocal() error {
+	names, err := ctx.ParseVarlist()
+	if err != nil || ctx.dryRun { return err }
+	frame, ok := ctx.Subroutine()
+	if !ok { return errors.New("LOCAL outside subroutine") }
+	if frame.Saved == nil { frame.Saved = make(Variables) }
+	for _, name := range names {
+		if value, ok := ctx.Variables[name]; !ok {
+			frame.Fresh = append(frame.Fresh, name)
+		} else if _, done := frame.Saved[name]; !done {
+			frame.Saved[name] = value
+		}
+		ctx.Assign(name, 0)
+	}
+	return nil
+}
+
+// Refuse to grow the stack past MaxStackDepth, to stop runaway recursion.
+func (ctx *Context) CheckStack() error {
+	if ctx.MaxStackDepth > 0 && ctx.stack.Len() >= ctx.MaxStackDepth {
+		return errors.New("Stack overflow")
 	}
+	return nil
 }
 
+// The variable where RETURN with an expression leaves its value.
+const ResultVar = "result"
+
+// Any loops left open by the subroutine are discarded.
 func (ctx *Context) ParseReturn() error {
-	if ctx.stack.Len() > 0 {
-		ctx.crt_line = ctx.stack.Remove(ctx.stack.Front()).(int)
-		return nil
-	} else {
-		return errors.New("RETURN without GOSUB.")
+	if !ctx.MatchEol() {
+		value, err := ctx.ParseExpression()
+		if err != nil { return err }
+		ctx.Assign(ResultVar, value)
+	}
+	if ctx.dryRun { return nil }
+	for ctx.stack.Len() > 0 {
+		frame := ctx.stack.Remove(ctx.stack.Front()).(*Frame)
+		if frame.Kind == GosubFrame {
+			for name, value := range frame.Saved {
+				ctx.Variables[name] = value
+			}
+			for _, name := range frame.Fresh {
+				delete(ctx.Variables, name)
+			}
+			ctx.crt_line = frame.Line
+			return nil
+		}
 	}
+	return errors.New("RETURN without GOSUB.")
+}
+
+func (ctx *Context) ParseDo() error {
+	if ctx.dryRun { return nil }
+	if err := ctx.CheckStack(); err != nil { return err }
+	ctx.stack.PushFront(&Frame{Kind: DoFrame, Line: ctx.crt_line})
+	return nil
 }
 
 func (ctx *Context) ParseLoop() error {
+	var again bool
 	if ctx.MatchNocase("while") {
 		value, err := ctx.ParseExpression()
-		if err != nil {
-			return err
-		} else if value != 0 {
-			ctx.crt_line = ctx.stack.Front().Value.(int)
-		} else {
-			ctx.stack.Remove(ctx.stack.Front())
-		}
+		if err != nil { return err }
+		again = value != 0
 	} else if ctx.MatchNocase("until") {
 		value, err := ctx.ParseExpression()
-		if err != nil {
-			return err
-		} else if value == 0 {
-			ctx.crt_line = ctx.stack.Front().Value.(int)
-		} else {
-			ctx.stack.Remove(ctx.stack.Front())
-		}
+		if err != nil { return err }
+		again = value == 0
 	} else {
 		return errors.New("Condition expected near " +
 			ctx.Line[ctx.Cursor:])
 	}
+	if ctx.dryRun { return nil }
+	frame, ok := ctx.TopFrame(DoFrame)
+	if !ok {
+		return errors.New("LOOP without DO.")
+	} else if again {
+		ctx.crt_line = frame.Line
+	} else {
+		ctx.stack.Remove(ctx.stack.Front())
+	}
 	return nil
 }
 
+// The context's own random number generator, so that interpreters don't
+// disturb each other. Until RANDOMIZE, it's seeded from the clock.
+func (ctx *Context) Random() *rand.Rand {
+	if ctx.rng == nil {
+		ctx.rng = rand.New(rand.NewSource(ctx.Clock().UnixNano()))
+	}
+	return ctx.rng
+}
+
+// Without a seed, RANDOMIZE takes one from the clock, kept small enough
+// for SEED to give it back exactly so that the run can be repeated.
 func (ctx *Context) ParseRandomize() error {
+	var seed int64
 	if ctx.MatchEol() {
-		rand.Seed(time.Now().UnixNano())
+		seed = ctx.Clock().UnixNano() & (1 << 53 - 1)
+	} else {
+		value, err := ctx.ParseArithmetic()
+		if err != nil { return err }
+		seed = int64(value)
+	}
+	if !ctx.dryRun {
+		ctx.LastSeed = seed
+		ctx.rng = rand.New(rand.NewSource(seed))
+	}
+	return nil
+}
+
+func (ctx *Context) ParseOption() error {
+	if ctx.MatchNocase("angle") {
+		if ctx.MatchNocase("degrees") {
+			ctx.AngleMode = Degrees
+		} else if ctx.MatchNocase("radians") {
+			ctx.AngleMode = Radians
+		} else {
+			return errors.New("DEGREES or RADIANS expected near " +
+				ctx.Line[ctx.Cursor:])
+		}
+	} else if ctx.MatchNocase("truth") {
+		if ctx.MatchNocase("names") {
+			ctx.TruthNames = true
+		} else if ctx.MatchNocase("numbers") {
+			ctx.TruthNames = false
+		} else {
+			return errors.New("NAMES or NUMBERS expected near " +
+				ctx.Line[ctx.Cursor:])
+		}
 	} else {
-		seed, err := ctx.ParseArithmetic()
+		return errors.New("Unknown option: " + ctx.Line[ctx.Cursor:])
+	}
+	return nil
+}
+
+// How long WAIT sleeps between checks of its condition.
+const WaitInterval = 10 * time.Millisecond
+
+func (ctx *Context) ParseWait() error {
+	mark := ctx.Cursor
+	value, err := ctx.ParseExpression()
+	if err != nil || ctx.dryRun { return err }
+	for value == 0 && !ctx.stop {
+		if err := ctx.CountStep(); err != nil { return err }
+		ctx.Sleep(WaitInterval)
+		ctx.Cursor = mark
+		value, err = ctx.ParseExpression()
 		if err != nil { return err }
-		rand.Seed(int64(seed))
 	}
 	return nil
 }
 
+// Pause as needed to keep successive FRAME statements at the given rate.
+func (ctx *Context) ParseFrame() error {
+	fps, err := ctx.ParseArithmetic()
+	if err != nil || ctx.dryRun {
+		return err
+	} else if fps <= 0 {
+		return errors.New("Frame rate must be positive")
+	}
+	period := time.Duration(float64(time.Second) / fps)
+	if !ctx.lastFrame.IsZero() && !ctx.stop {
+		if delay := period - ctx.Clock().Sub(ctx.lastFrame); delay > 0 {
+			ctx.Sleep(delay)
+		}
+	}
+	ctx.lastFrame = ctx.Clock()
+	return nil
+}
+
+func (ctx *Context) ParseSleep() error {
+	seconds, err := ctx.ParseArithmetic()
+	if err != nil || ctx.dryRun {
+		return err
+	} else if seconds < 0 {
+		return errors.New("Negative sleep time")
+	}
+	ctx.Sleep(time.Duration(seconds * float64(time.Second)))
+	return nil
+}
+
+// Pause the program, letting the host do so its own way if it wishes.
+func (ctx *Context) Sleep(d time.Duration) {
+	if ctx.OnSleep != nil {
+		ctx.OnSleep(d)
+	} else {
+		time.Sleep(d)
+	}
+}
+
+// END and STOP may be followed by an exit status, e.g. END 2.
+func (ctx *Context) ParseEnd() error {
+	if ctx.MatchNocase("select") { return nil }
+	if err := ctx.ParseExitCode(); err != nil { return err }
+	ctx.crt_line = len(ctx.addr)
+	return nil
+}
+
+func (ctx *Context) ParseStop() error {
+	if err := ctx.ParseExitCode(); err != nil || ctx.dryRun { return err }
+	ctx.stop = true
+	return nil
+}
+
+func (ctx *Context) ParseExitCode() error {
+	if ctx.MatchEol() { return nil }
+	code, err := ctx.ParseArithmetic()
+	if err == nil && !ctx.dryRun { ctx.ExitCode = int(code) }
+	return err
+}
+
+// Jump to the body of the first CASE whose clauses match the value.
+func (ctx *Context) ParseSelect() error {
+	if !ctx.MatchNocase("case") {
+		return errors.New("CASE expected near " + ctx.Line[ctx.Cursor:])
+	}
+	value, err := ctx.ParseExpression()
+	if err != nil || ctx.dryRun { return err } // CASE lines check themselves.
+	if ctx.addr == nil { return errors.New("Program not running.") }
+	depth := 0
+	for i := ctx.crt_line; i < len(ctx.addr); i++ {
+		text := ctx.Program[ctx.addr[i]]
+		switch LeadingKeyword(text) {
+			case "select": depth++
+			case "end":
+				if !IsEndSelect(text) {
+					break
+				} else if depth > 0 {
+					depth--
+				} else {
+					ctx.crt_line = i + 1
+					return nil
+				}
+			case "case":
+				if depth > 0 { break }
+				ctx.line_num = ctx.addr[i]
+				ctx.Line = text
+				ctx.Cursor = 0
+				ctx.MatchLabel()
+				ctx.SkipWhitespace()
+				ctx.MatchKeyword()
+				matched, err := ctx.MatchCase(value)
+				if err != nil {
+					return err
+				} else if matched {
+					ctx.crt_line = i + 1
+					return nil
+				}
+		}
+	}
+	return errors.New("SELECT without END SELECT.")
+}
+
+// Reaching another CASE means the selected one is done.
+func (ctx *Context) ParseCase() error {
+	if ctx.dryRun {
+		_, err := ctx.MatchCase(0)
+		return err
+	} else if ctx.addr == nil { return errors.New("Program not running.") }
+	depth := 0
+	for i := ctx.crt_line; i < len(ctx.addr); i++ {
+		text := ctx.Program[ctx.addr[i]]
+		if LeadingKeyword(text) == "select" {
+			depth++
+		} else if !IsEndSelect(text) {
+			continue
+		} else if depth > 0 {
+			depth--
+		} else {
+			ctx.crt_line = i + 1
+			return nil
+		}
+	}
+	return errors.New("CASE without END SELECT.")
+}
+
+// Check a value against the comma-separated clauses of a CASE statement.
+func (ctx *Context) MatchCase(value float64) (bool, error) {
+	if ctx.MatchNocase("else") { return true, nil }
+	matched := false
+	for {
+		ok, err := ctx.MatchCaseClause(value)
+		if err != nil { return false, err }
+		matched = matched || ok
+		if !ctx.Match(",") { return matched, nil }
+	}
+}
+
+func (ctx *Context) MatchCaseClause(value float64) (bool, error) {
+	if ctx.MatchNocase("is") {
+		if !ctx.MatchRelation() {
+			return false, errors.New(
+				"Operator expected near " + ctx.Line[ctx.Cursor:])
+		}
+		op := ctx.Token
+		rside, err := ctx.ParseArithmetic()
+		if err != nil { return false, err }
+		result, err := Compare(op, value, rside)
+		return result != 0, err
+	}
+	low, err := ctx.ParseArithmetic()
+	if err != nil {
+		return false, err
+	} else if ctx.MatchNocase("to") {
+		high, err := ctx.ParseArithmetic()
+		return value >= low && value <= high, err
+	} else {
+		return value == low, nil
+	}
+}
+
+func IsEndSelect(text string) bool {
+	scan := Context{Line: text}
+	scan.MatchLabel()
+	scan.SkipWhitespace()
+	return scan.MatchKeyword() && scan.Token == "end" &&
+		scan.MatchNocase("select")
+}
+
 func (ctx *Context) ParseExpression() (float64, error) {
 	return ctx.ParseDisjunction()
 }
@@ -479,6 +2357,7 @@ func (ctx *Context) ParseDisjunction() (float64, error) {
 		rside, err := ctx.ParseConjunction()
 		if err != nil { return 0, err }
 		lside = Bool2float(lside != 0 || rside != 0)
+		ctx.boolean = true
 	}
 	return lside, nil
 }
@@ -490,6 +2369,7 @@ func (ctx *Context) ParseConjunction() (float64, error) {
 		rside, err := ctx.ParseNegation()
 		if err != nil { return 0, err }
 		lside = Bool2float(lside != 0 && rside != 0)
+		ctx.boolean = true
 	}
 	return lside, nil
 }
@@ -497,6 +2377,7 @@ func (ctx *Context) ParseConjunction() (float64, error) {
 func (ctx *Context) ParseNegation() (float64, error) {
 	if ctx.MatchNocase("not") {
 		value, err := ctx.ParseComparison()
+		ctx.boolean = true
 		return Bool2float(value == 0), err
 	} else {
 		// Leave purely arithmetic results intact
@@ -505,7 +2386,10 @@ func (ctx *Context) ParseNegation() (float64, error) {
 }
 
 func (ctx *Context) ParseComparison() (float64, error) {
+	mark := ctx.Cursor
 	lside, err := ctx.ParseArithmetic()
+	// A comparison in parentheses, like (1 > 0), is still a truth value.
+	ctx.boolean = ctx.boolean && IsParenthesized(ctx.Line[mark:ctx.Cursor])
 	if err != nil {
 		return 0, err
 	} else if !ctx.MatchRelation() {
@@ -514,19 +2398,43 @@ func (ctx *Context) ParseComparison() (float64, error) {
 		op := ctx.Token
 		rside, err := ctx.ParseArithmetic()
 		if err != nil { return 0, nil }
-		switch op {
-			case "<=": return Bool2float(lside <= rside), nil
-			case "<": return Bool2float(lside < rside), nil
-			case "=": return Bool2float(lside == rside), nil
-			case "<>": return Bool2float(lside != rside), nil
-			case ">": return Bool2float(lside > rside), nil
-			case ">=": return Bool2float(lside >= rside), nil
-			default: return 0, errors.New(
-				"Unknown operator: " + op)
+		ctx.boolean = true
+		return Compare(op, lside, rside)
+	}
+}
+
+// Whether text is all one parenthesized expression, as "(a) + (b)" isn't.
+func IsParenthesized(text string) bool {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "(") { return false }
+	depth, quoted := 0, false
+	for i := 0; i < len(text); i++ {
+		switch {
+			case text[i] == '"': quoted = !quoted
+			case quoted: continue
+			case text[i] == '(': depth++
+			case text[i] == ')':
+				depth--
+				if depth == 0 { return i == len(text) - 1 }
 		}
 	}
+	return false
+}
+
+func Compare(op string, lside, rside float64) (float64, error) {
+	switch op {
+		case "<=": return Bool2float(lside <= rside), nil
+		case "<": return Bool2float(lside < rside), nil
+		case "=": return Bool2float(lside == rside), nil
+		case "<>": return Bool2float(lside != rside), nil
+		case ">": return Bool2float(lside > rside), nil
+		case ">=": return Bool2float(lside >= rside), nil
+		default: return 0, errors.New("Unknown operator: " + op)
+	}
 }
 
+// True is -1 as in classic BASIC, so -((a > b) + (c > d)) counts how many
+// of the conditions hold. The BOOL function normalizes truth to 1 instead.
 func Bool2float(value bool) float64 {
 	if value { return -1 } else { return 0 }
 }
@@ -602,12 +2510,28 @@ func (ctx *Context) ParseFactor() (float64, error) {
 		return value * signum, err
 	} else if ctx.MatchVarname() {
 		name := ctx.Token
-		if _, ok := Functions[name]; ok {
+		if _, ok := TextFunctions[name]; ok {
+			args, err := ctx.ParseValueArgs()
+			if err != nil { return 0, err }
+			result, err := ctx.CallText(name, args)
+			if err == nil && result.IsStr {
+				err = errors.New("Type mismatch in call to " + name)
+			}
+			return result.Num * signum, err
+		} else if ctx.Match("$") {
+			return 0, errors.New("Number expected, found " + name + "$")
+		} else if IsFunction(name) {
 			args, err := ctx.ParseArgs()
 			if err != nil { return 0, err }
-			return CallBuiltin(name, args)
+			value, err := ctx.CallFunction(name, args)
+			return value * signum, err
 		} else if value, ok := ctx.Variables[name]; ok {
 			return value * signum, nil
+		} else if ctx.dryRun {
+			return 0, nil // Could be set by a line that didn't run.
+		} else if ctx.AutoZero {
+			ctx.Warn("Variable " + name + " used before assignment")
+			return 0, nil
 		} else {
 			return 0, errors.New("Variable not found: " + name)
 		}
@@ -652,6 +2576,134 @@ func (ctx *Context) ParseArgs() ([]float64, error) {
 	}
 }
 
+// Parse an expression without evaluating it, and describe its structure
+// as a fully parenthesized string, e.g. "(1 + (2 * 3))". For teaching.
+func (ctx *Context) ParseTree() (string, error) {
+	return ctx.treeBinary(ctx.treeConjunction, func () bool {
+		return ctx.MatchNocase("or")
+	})
+}
+
+func (ctx *Context) treeConjunction() (string, error) {
+	return ctx.treeBinary(ctx.treeNegation, func () bool {
+		return ctx.MatchNocase("and")
+	})
+}
+
+func (ctx *Context) treeNegation() (string, error) {
+	if ctx.MatchNocase("not") {
+		operand, err := ctx.treeComparison()
+		return "(not " + operand + ")", err
+	} else {
+		return ctx.treeComparison()
+	}
+}
+
+func (ctx *Context) treeComparison() (string, error) {
+	lside, err := ctx.treeArithmetic()
+	if err != nil || !ctx.MatchRelation() {
+		return lside, err
+	}
+	op := ctx.Token
+	rside, err := ctx.treeArithmetic()
+	return "(" + lside + " " + op + " " + rside + ")", err
+}
+
+func (ctx *Context) treeArithmetic() (string, error) {
+	return ctx.treeBinary(ctx.treeTerm, ctx.MatchAddSub)
+}
+
+func (ctx *Context) treeTerm() (string, error) {
+	return ctx.treeBinary(ctx.treePower, ctx.MatchMulDiv)
+}
+
+func (ctx *Context) treePower() (string, error) {
+	base, err := ctx.treeFactor()
+	if err != nil || !ctx.Match("^") {
+		return base, err
+	}
+	exponent, err := ctx.treePower()
+	return "(" + base + " ^ " + exponent + ")", err
+}
+
+func (ctx *Context) treeFactor() (string, error) {
+	sign := ""
+	if ctx.Match("-") {
+		sign = "-"
+	} else {
+		ctx.Match("+")
+	}
+	
+	if ctx.MatchNumber() {
+		return sign + ctx.Token, nil
+	} else if ctx.MatchVarname() {
+		name := ctx.Token
+		if ctx.Match("$") {
+			name += "$"
+			if _, ok := TextFunctions[name]; !ok {
+				return "", errors.New("No such function: " + name)
+			}
+		} else if !IsFunction(name) {
+			return sign + name, nil
+		}
+		args, err := ctx.treeArgs()
+		return sign + name + "(" + strings.Join(args, ", ") + ")", err
+	} else if ctx.Match("(") {
+		inner, err := ctx.ParseTree()
+		if err != nil {
+			return "", err
+		} else if !ctx.Match(")") {
+			return "", errors.New(
+				"Missing ')' near " + ctx.Line[ctx.Cursor:])
+		} else if sign != "" {
+			return "-(" + inner + ")", nil
+		} else {
+			return inner, nil
+		}
+	} else {
+		return "", errors.New(
+			"Expression expected near " + ctx.Line[ctx.Cursor:])
+	}
+}
+
+func (ctx *Context) treeArgs() ([]string, error) {
+	args := make([]string, 0, 3)
+	if !ctx.Match("(") || ctx.Match(")") {
+		return args, nil
+	}
+	for {
+		arg, ok, err := ctx.ParseStringLiteral()
+		if ok {
+			arg = "\"" + arg + "\""
+		} else if err == nil {
+			arg, err = ctx.ParseTree()
+		}
+		if err != nil { return args, err }
+		args = append(args, arg)
+		if ctx.Match(")") {
+			return args, nil
+		} else if !ctx.Match(",") {
+			return args, errors.New(
+				"Missing ')' near " + ctx.Line[ctx.Cursor:])
+		}
+	}
+}
+
+// Left-associative chain of operands separated by matching operators.
+func (ctx *Context) treeBinary(
+	operand func () (string, error), operator func () bool,
+) (string, error) {
+	lside, err := operand()
+	if err != nil { return "", err }
+	for operator() {
+		op := ctx.Token
+		rside, err := operand()
+		if err != nil { return "", err }
+		lside = "(" + lside + " " + op + " " + rside + ")"
+	}
+	return lside, nil
+}
+
 func (ctx *Context) MatchKeyword() bool {
 	if ctx.Cursor >= len(ctx.Line) || !hasLetterAt(ctx.Line, ctx.Cursor) {
 		return false
@@ -664,24 +2716,55 @@ func (ctx *Context) MatchKeyword() bool {
 	return true
 }
 
+// Names start with a letter, then may have letters, digits and underscores.
 func (ctx *Context) MatchVarname() bool {
 	ctx.SkipWhitespace()
 	if ctx.Cursor >= len(ctx.Line) || !hasLetterAt(ctx.Line, ctx.Cursor) {
 		return false
 	}
 	mark := ctx.Cursor
-	for ctx.Cursor < len(ctx.Line) && hasAlnumAt(ctx.Line, ctx.Cursor) {
+	for ctx.Cursor < len(ctx.Line) && (hasAlnumAt(ctx.Line, ctx.Cursor) ||
+			ctx.Line[ctx.Cursor] == '_') {
 		ctx.Cursor++
 	}
 	ctx.Token = strings.ToLower(ctx.Line[mark:ctx.Cursor])
 	return true
 }
 
+// Look ahead for an assignment without LET, as in "x = 5". Statement
+// keywords can't be assigned to this way. Leaves Context.Cursor as it was.
+func (ctx *Context) MatchAssignment() bool {
+	mark := ctx.Cursor
+	found := ctx.MatchVarname() && !IsStatement(ctx.Token) && ctx.Match("=")
+	ctx.Cursor = mark
+	return found
+}
+
+// Match a label definition such as "start:", leaving its name in Token.
+func (ctx *Context) MatchLabel() bool {
+	mark := ctx.Cursor
+	if ctx.MatchVarname() && ctx.Cursor < len(ctx.Line) &&
+		ctx.Line[ctx.Cursor] == ':' {
+		ctx.Cursor++
+		return true
+	} else {
+		ctx.Cursor = mark
+		return false
+	}
+}
+
+// The digits before the point may be left out, as in .5, but a point
+// on its own isn't a number.
 func (ctx *Context) MatchNumber() bool {
 	ctx.SkipWhitespace()
 	mark := ctx.Cursor
 	ctx.SkipDigits()
-	if (mark == ctx.Cursor) {
+	if mark == ctx.Cursor && ctx.Cursor + 1 < len(ctx.Line) &&
+			ctx.Line[ctx.Cursor] == '.' &&
+			hasDigitAt(ctx.Line, ctx.Cursor + 1) {
+		ctx.Cursor++
+		ctx.SkipDigits()
+	} else if (mark == ctx.Cursor) {
 		return false
 	} else if (ctx.Cursor < len(ctx.Line) && ctx.Line[ctx.Cursor] == '.') {
 		ctx.Cursor++
@@ -697,13 +2780,17 @@ func (ctx *Context) MatchEol() bool {
 }
 
 // Always try to match the longer operators first.
-var RelOp = [6]string{"<=", "<>", ">=", "<", "=", ">"}
+var RelOp = [9]string{"<=", "<>", ">=", "=<", "><", "=>", "<", "=", ">"}
+
+// Spellings accepted from other dialects, and what they stand for.
+var RelAlias = map[string]string{"=<": "<=", "><": "<>", "=>": ">="}
 
 func (ctx *Context) MatchRelation() bool {
 	ctx.SkipWhitespace()
 	for _, i := range RelOp {
 		if strings.HasPrefix(ctx.Line[ctx.Cursor:], i) {
 			ctx.Token = i;
+			if alias, ok := RelAlias[i]; ok { ctx.Token = alias }
 			ctx.Cursor += len(i)
 			return true
 		}
@@ -791,6 +2878,21 @@ func hasSpaceAt(text string, index int) bool {
 	return unicode.IsSpace(rune(text[index]))
 }
 
+// The statement keyword a program line starts with, in lowercase, or ""
+// for an assignment without LET, such as "loop_n = 5".
+func LeadingKeyword(text string) string {
+	scan := Context{Line: text}
+	scan.MatchLabel()
+	scan.SkipWhitespace()
+	if scan.MatchAssignment() {
+		return ""
+	} else if scan.MatchKeyword() {
+		return scan.Token
+	} else {
+		return ""
+	}
+}
+
 func IndexOf(needle int, haystack []int) int {
 	for i, num := range haystack {
 		if num == needle { return i }
@@ -799,26 +2901,72 @@ func IndexOf(needle int, haystack []int) int {
 }
 
 func (ctx *Context) RunProgram() error {
+	if err := ctx.ResetProgram(); err != nil { return err }
+	return ctx.ContinueProgram()
+}
+
+// Like RunProgram, but start from the given line instead of the first.
+func (ctx *Context) RunFrom(ln int) error {
+	if err := ctx.ResetProgram(); err != nil { return err }
+	idx := IndexOf(ln, ctx.addr)
+	if idx < 0 {
+		return errors.New("Line not found: " + strconv.Itoa(ln))
+	}
+	ctx.crt_line = idx
+	return ctx.ContinueProgram()
+}
+
+// Prepare to run the program from the top.
+func (ctx *Context) ResetProgram() error {
 	ctx.stack.Init()
 	ctx.addr = ctx.Program.LineNumbers()
 	ctx.crt_line = 0
-	return ctx.ContinueProgram()
+	ctx.steps = 0
+	ctx.ExitCode = 0
+	return ctx.IndexLabels()
+}
+
+// Find all the labels defined in the program, for use by GOTO and GOSUB.
+func (ctx *Context) IndexLabels() error {
+	ctx.labels = make(map[string]int)
+	for _, ln := range ctx.Program.LineNumbers() {
+		scan := Context{Line: ctx.Program[ln]}
+		if !scan.MatchLabel() {
+			continue
+		} else if _, ok := ctx.labels[scan.Token]; ok {
+			return errors.New(
+				"Duplicate label " + scan.Token +
+				" in line " + strconv.Itoa(ln))
+		} else {
+			ctx.labels[scan.Token] = ln
+		}
+	}
+	return nil
 }
 
+// Any OUTPUT redirections made by the program are undone when it ends.
 func (ctx *Context) ContinueProgram() error {
 	var err error
 	ctx.stop = false
+	defer ctx.RestoreOutput(len(ctx.outputs))
 	for ctx.crt_line < len(ctx.addr) && !ctx.stop {
 		ctx.line_num = ctx.addr[ctx.crt_line]
 		ctx.Line = ctx.Program[ctx.line_num]
 		ctx.crt_line++
 		ctx.Cursor = 0
-		err = ctx.ParseStatement()
+		if ctx.trace && ctx.TraceOut != nil {
+			fmt.Fprintf(ctx.TraceOut, "[%d]\n", ctx.line_num)
+		}
+		if ctx.profiling {
+			ctx.profile[ctx.line_num]++
+		}
+		err = ctx.CountStep()
+		if err == nil {
+			err = ctx.ParseStatement()
+		}
 		if err != nil {
-			fmt.Fprint(Errs, err);
-			fmt.Fprint(Errs, " in line ", ctx.line_num);
-			fmt.Fprintln(Errs, ", column ", ctx.Cursor);
-			break
+			return fmt.Errorf("%v in line %d, column %d%s",
+				err, ctx.line_num, ctx.Cursor, ctx.Traceback())
 		}
 	}
 	return err
@@ -826,25 +2974,369 @@ func (ctx *Context) ContinueProgram() error {
 
 func (ctx *Context) Stopped() bool { return ctx.stop }
 
+// Handle the PROFILE command: ON resets the counts, OFF pauses counting,
+// and REPORT lists the lines that ran, most often executed first.
+func (ctx *Context) ParseProfile() error {
+	if ctx.MatchNocase("on") {
+		ctx.profile = make(map[int]int)
+		ctx.profiling = true
+	} else if ctx.MatchNocase("off") {
+		ctx.profiling = false
+	} else if ctx.MatchNocase("report") {
+		ctx.ProfileReport(ctx.Stdout())
+	} else {
+		return errors.New("ON, OFF or REPORT expected")
+	}
+	return nil
+}
+
+// Program lines that never ran since PROFILE ON, to help find dead code.
+func (ctx *Context) Uncovered() ([]int, error) {
+	if ctx.profile == nil {
+		return nil, errors.New("No profile; use PROFILE ON and RUN first.")
+	}
+	lines := make([]int, 0)
+	for _, ln := range ctx.Program.LineNumbers() {
+		if ctx.profile[ln] == 0 {
+			lines = append(lines, ln)
+		}
+	}
+	return lines, nil
+}
+
+func (ctx *Context) ProfileReport(w io.Writer) {
+	lines := make([]int, 0, len(ctx.profile))
+	for ln := range ctx.profile {
+		lines = append(lines, ln)
+	}
+	sort.Slice(lines, func (i, j int) bool {
+		a, b := ctx.profile[lines[i]], ctx.profile[lines[j]]
+		return a > b || (a == b && lines[i] < lines[j])
+	})
+	for _, ln := range lines {
+		fmt.Fprintf(w, "%d\t%d\t%s\n", ctx.profile[ln], ln, ctx.Program[ln])
+	}
+}
+
+// Parse every program line without running it, collecting all errors.
+func (ctx *Context) CheckSyntax() []error {
+	scratch := Context{
+		Variables: make(Variables),
+		Program: ctx.Program,
+		dryRun: true,
+	}
+	scratch.addr = ctx.Program.LineNumbers()
+	errs := make([]error, 0)
+	if err := scratch.IndexLabels(); err != nil {
+		errs = append(errs, err)
+	}
+	for i, ln := range scratch.addr {
+		scratch.line_num = ln
+		scratch.crt_line = i + 1
+		scratch.Line = ctx.Program[ln]
+		scratch.Cursor = 0
+		if err := scratch.ParseStatement(); err != nil {
+			errs = append(errs, errors.New(
+				err.Error() + " in line " + strconv.Itoa(ln)))
+		} else if !scratch.MatchEol() {
+			errs = append(errs, errors.New(
+				"End of statement expected, found: " +
+				scratch.Line[scratch.Cursor:] + " in line " + strconv.Itoa(ln)))
+		}
+	}
+	for _, w := range ctx.Program.CheckNesting() {
+		errs = append(errs, errors.New(
+			w.Message + " in line " + strconv.Itoa(w.Line)))
+	}
+	return errs
+}
+
+// Look for FOR and DO loops that aren't closed in the order they're opened,
+// going through the program text in line order. Loop statements after
+// THEN aren't counted, since they may or may not run.
+func (prog Program) CheckNesting() []Warning {
+	_, problems := prog.Nesting()
+	return problems
+}
+
+// How many loops each line is inside, as CheckNesting sees it, along with
+// any problems found. Lines that open or close a loop count as outside it.
+func (prog Program) Nesting() (map[int]int, []Warning) {
+	type opening struct { keyword string; line int }
+	depths := make(map[int]int)
+	open := make([]opening, 0)
+	problems := make([]Warning, 0)
+	closeLoop := func (ln int, want, closer string) {
+		if len(open) == 0 {
+			problems = append(problems,
+				Warning{ln, closer + " without " + want})
+			return
+		}
+		top := open[len(open) - 1]
+		open = open[:len(open) - 1]
+		if top.keyword != want {
+			problems = append(problems, Warning{ln, closer + " closes " +
+				top.keyword + " from line " + strconv.Itoa(top.line)})
+		}
+	}
+	for _, ln := range prog.LineNumbers() {
+		keyword := LeadingKeyword(prog[ln])
+		switch keyword {
+			case "for": open = append(open, opening{"FOR", ln})
+			case "do": open = append(open, opening{"DO", ln})
+			case "next":
+				closes := strings.Count(prog[ln], ",") + 1
+				for i := 0; i < closes; i++ {
+					closeLoop(ln, "FOR", "NEXT")
+				}
+			case "loop": closeLoop(ln, "DO", "LOOP")
+		}
+		depths[ln] = len(open)
+		if keyword == "for" || keyword == "do" {
+			depths[ln]--
+		}
+	}
+	for _, o := range open {
+		closer := map[string]string{"FOR": "NEXT", "DO": "LOOP"}[o.keyword]
+		problems = append(problems,
+			Warning{o.line, o.keyword + " without " + closer})
+	}
+	return depths, problems
+}
+
+// Account for one more unit of work, failing once MaxSteps is exceeded.
+func (ctx *Context) CountStep() error {
+	ctx.steps++
+	if ctx.MaxSteps > 0 && ctx.steps > ctx.MaxSteps {
+		return errors.New("Step limit exceeded")
+	}
+	return nil
+}
+
+// Renumber the program from start in steps of step, updating GOTO, GOSUB,
+// THEN and ELSE targets given as plain line numbers. Computed targets are
+// left as they are, with a warning. If the new numbers would go past
+// MaxLineNumber, only a warning is given and the program is unchanged.
+func (ctx *Context) Renumber(start, step int) bool {
+	lines := ctx.Program.LineNumbers()
+	if len(lines) == 0 { return true }
+	limit := ctx.MaxLineNumber
+	if limit <= 0 { limit = math.MaxInt }
+	// Compared this way round, as the last line number could overflow.
+	n := len(lines) - 1
+	if start > limit || n > 0 && step > (limit - start) / n {
+		ctx.Warn(fmt.Sprintf(
+			"RENUM would need line numbers past the maximum of %d", limit))
+		return false
+	}
+	ctx.IndexLabels() // Duplicates don't matter here.
+	mapping := make(map[int]int)
+	for i, ln := range lines {
+		mapping[ln] = start + step * i
+	}
+	prog := make(Program)
+	for _, ln := range lines {
+		prog[mapping[ln]] = ctx.RenumberLine(ln, mapping)
+	}
+	ctx.Program = prog
+	ctx.IndexLabels()
+	for i, ln := range ctx.addr { // So that CONTINUE still works.
+		if updated, ok := mapping[ln]; ok { ctx.addr[i] = updated }
+	}
+	return true
+}
+
+// The text of line ln with its jump targets mapped to new line numbers.
+// Warnings give the new number of the line.
+func (ctx *Context) RenumberLine(ln int, mapping map[int]int) string {
+	text := ctx.Program[ln]
+	if LeadingKeyword(text) == "rem" { return text }
+	for _, kw := range []string{"goto", "gosub", "then", "else"} {
+		for from := 0; from < len(text); {
+			at := FindWord(text, from, kw)
+			if at == len(text) { break }
+			scan := Context{Line: text, Cursor: at + len(kw)}
+			from = scan.Cursor
+			mark := scan.Cursor
+			if !scan.MatchNumber() {
+				if kw == "then" || kw == "else" {
+					continue // A statement, not a line number.
+				} else if scan.MatchVarname() {
+					if _, ok := ctx.labels[scan.Token]; ok { continue }
+				}
+				ctx.WarnAt(mapping[ln], "Can't renumber computed " +
+					strings.ToUpper(kw) + " target")
+				continue
+			}
+			target, err := strconv.Atoi(scan.Token)
+			end := scan.Cursor
+			args := kw == "gosub" && scan.Match("(") // GOSUB n (args)
+			if err != nil || !args && !scan.MatchEol() &&
+				FindWord(text, scan.Cursor, "else") != scan.Cursor {
+				ctx.WarnAt(mapping[ln], "Can't renumber computed " +
+					strings.ToUpper(kw) + " target")
+				continue
+			}
+			updated, ok := mapping[target]
+			if !ok {
+				ctx.WarnAt(mapping[ln], "Line not found: " + scan.Token)
+				continue
+			}
+			number := strconv.Itoa(updated)
+			text = text[:mark] + " " + number + text[end:]
+			from = mark + 1 + len(number)
+		}
+	}
+	return text
+}
+
+// Files can INCLUDE each other, as long as they don't do so in a cycle
+// or use the same line numbers.
 func (ctx *Context) LoadFile(fn string) error {
-	file, err := os.Open(fn)
+	if len(ctx.loading) > 0 && !filepath.IsAbs(fn) {
+		fn = filepath.Join(filepath.Dir(ctx.LoadingFile()), fn)
+	}
+	path, err := filepath.Abs(fn)
+	if err != nil { return err }
+	for _, f := range ctx.loading {
+		if f == path { return errors.New("Include cycle: " + fn) }
+	}
+	file, err := os.Open(path)
 	if err != nil { return err }
 	defer file.Close()
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		ctx.Line = scanner.Text()
+	if len(ctx.loading) == 0 { ctx.origin = make(map[int]string) }
+	ctx.loading = append(ctx.loading, path)
+	defer func () { ctx.loading = ctx.loading[:len(ctx.loading) - 1] }()
+	return ctx.Load(file)
+}
+
+func (ctx *Context) LoadingFile() string {
+	return ctx.loading[len(ctx.loading) - 1]
+}
+
+// INCLUDE "file" loads the lines of another file, relative to the one
+// being loaded. Put it on an unnumbered line to do so at load time.
+func (ctx *Context) ParseInclude() error {
+	fn, err := ctx.ParseFilename()
+	if err != nil || ctx.dryRun { return err }
+	ctx.including++
+	defer func () { ctx.including-- }()
+	return ctx.LoadFile(fn)
+}
+
+// Add the numbered lines read from r to the program; unnumbered lines are
+// run as they're read. If no line has a number, though, the program is
+// taken to use labels only, and each line is numbered as in the source.
+// An included file like that is numbered on from the end of the program.
+// Unnumbered INCLUDE lines run last, so that included lines come after.
+func (ctx *Context) Load(r io.Reader) error {
+	type sourceLine struct { number int; text string }
+	lines := make([]sourceLine, 0)
+	numbered := false
+	scanner := bufio.NewScanner(r)
+	pending, first := "", 0
+	for count := 1; scanner.Scan(); count++ {
+		if pending == "" { first = count }
+		text, continued := ContinuedLine(scanner.Text())
+		pending = JoinLines(pending, text)
+		if continued { continue }
+		lines = append(lines, sourceLine{first, pending})
+		trimmed := strings.TrimSpace(pending)
+		numbered = numbered || trimmed != "" && hasDigitAt(trimmed, 0)
+		pending = ""
+	}
+	if pending != "" {
+		lines = append(lines, sourceLine{first, pending})
+	}
+	if err := scanner.Err(); err != nil { return err }
+	
+	base := 0
+	if numbers := ctx.Program.LineNumbers(); ctx.including > 0 &&
+			len(numbers) > 0 {
+		base = numbers[len(numbers) - 1]
+	}
+	includes := make([]string, 0)
+	for _, line := range lines {
+		ctx.Line = line.text
 		ctx.Cursor = 0
-		err = ctx.ParseLine()
+		if LeadingKeyword(line.text) == "include" {
+			includes = append(includes, line.text)
+			continue
+		} else if numbered {
+			// As it is.
+		} else if strings.TrimSpace(line.text) == "" {
+			continue
+		} else {
+			ctx.Line = strconv.Itoa(base + line.number) + " " + line.text
+		}
+		err := ctx.ParseLine()
 		if err != nil { return err }
 	}
-	return scanner.Err()
+	for _, text := range includes {
+		ctx.Line = text
+		ctx.Cursor = 0
+		if err := ctx.ParseLine(); err != nil { return err }
+	}
+	if ctx.including == 0 { // Not for each included file.
+		for _, w := range ctx.Program.CheckNesting() {
+			ctx.WarnAt(w.Line, w.Message) // Once, however often it's loaded.
+		}
+	}
+	return nil
+}
+
+// Whether a source line ends in a space and an underscore, outside any
+// string, meaning that it goes on in the next line. Also returns the line
+// without that ending.
+func ContinuedLine(line string) (string, bool) {
+	body := strings.TrimRight(line, " \t")
+	if !strings.HasSuffix(body, "_") {
+		return line, false
+	}
+	body = body[:len(body) - 1]
+	if body != "" && !strings.HasSuffix(body, " ") &&
+		!strings.HasSuffix(body, "\t") {
+		return line, false // Part of a name.
+	} else if strings.Count(body, "\"") % 2 == 1 {
+		return line, false // Inside a string.
+	}
+	return body, true
+}
+
+// Add a continuation line to the ones before it.
+func JoinLines(pending, text string) string {
+	if pending == "" { return text }
+	return pending + strings.TrimLeft(text, " \t")
+}
+
+// Run a program given as source text on a fresh context, reading input
+// from a string, and give back what it wrote to Out and Err. The clock is
+// stopped at midnight, January 1st 2000, and the random seed is 1, so the
+// results are the same every time.
+func RunCaptured(source, input string) (string, string, error) {
+	var out, errs strings.Builder
+	ctx := NewContext()
+	ctx.In = strings.NewReader(input)
+	ctx.Out = &out
+	ctx.Err = &errs
+	ctx.TraceOut = &errs
+	ctx.Now = func () time.Time {
+		return time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	}
+	ctx.LastSeed = 1
+	ctx.rng = rand.New(rand.NewSource(ctx.LastSeed))
+	err := ctx.Load(strings.NewReader(source))
+	if err == nil {
+		err = ctx.RunProgram()
+	}
+	return out.String(), errs.String(), err
 }
 
 func (ctx *Context) SaveFile(fn string) error {
 	file, err := os.Create(fn)
 	if err != nil { return err }
 	defer file.Close()
-	fmt.Fprintln(Errs, "Opening file: " + fn)
+	fmt.Fprintln(ctx.Stderr(), "Opening file: " + fn)
 	for _, i := range ctx.Program.LineNumbers() {
 		_, err = fmt.Fprintf(file, "%d\t%s\n", i, ctx.Program[i])
 		if (err != nil) { return err }
@@ -852,89 +3344,246 @@ func (ctx *Context) SaveFile(fn string) error {
 	return nil
 }
 
-func (ctx *Context) CommandLoop(banner string) {
-	fmt.Fprintln(Outs, banner);
-	fmt.Fprint(Outs, "> ")
-	scanner := bufio.NewScanner(Ins)
-	for scanner.Scan() {
-		ctx.Line = scanner.Text()
-		if len(ctx.Line) == 0 { fmt.Fprint(Outs, "> "); continue }
-		ctx.Cursor = 0
+// Returned by ExecLine when the user types BYE.
+var ErrBye = errors.New("BYE")
+
+// Commands only available in the command loop, as opposed to statements.
+// Each is called with the cursor just past its name.
+var Commands = map[string]func (ctx *Context) error {
+	"bye": func (ctx *Context) error { return ErrBye },
+	"help": (*Context).ParseHelp,
+	"renum": func (ctx *Context) error {
+		start, step := 10, 10
 		var err error
-		
-		if hasDigitAt(ctx.Line, 0) {
-			err = ctx.ParseLine()
-		} else if !ctx.MatchKeyword() {
-			err = errors.New("Command expected")
-		} else if ctx.Token == "bye" {
-			break
-		} else if ctx.Token == "list" {
-			for _, i := range ctx.Program.LineNumbers() {
-				fmt.Fprintf(Outs, "%d\t%s\n", i, ctx.Program[i])
-			}
-		} else if ctx.Token == "run" {
-			ctx.RunProgram()
-		} else if ctx.Token == "continue" {
-			ctx.ContinueProgram()
-		} else if ctx.Token == "clear" {
-			ctx.Variables = make(Variables)
-		} else if ctx.Token == "new" {
-			ctx.Program = make(Program)
-		} else if ctx.Token == "delete" {
-			if ctx.MatchNumber() {
-				ln, _ := strconv.Atoi(ctx.Token)
-				delete(ctx.Program, ln)
-			} else {
-				err = errors.New("Line # expected")
-			}
-		} else if ctx.Token == "load" {
-			if ok, err := ctx.MatchedString(); ok {
-				err = ctx.LoadFile(ctx.Token)
-				if err == nil {
-					fmt.Fprintln(Outs, "File loaded.")
-				} else {
-					fmt.Fprintln(Errs, err)
-				}
-			} else if err == nil {
-				fmt.Fprintln(Errs, "String expected.")
-			} else {
-				fmt.Fprintln(Errs, err)
-			}
-		} else if ctx.Token == "save" {
-			if ok, err := ctx.MatchedString(); ok {
-				err = ctx.SaveFile(ctx.Token)
-				if err == nil {
-					fmt.Fprintln(Outs, "File saved.")
-				} else {
-					fmt.Fprintln(Errs, err)
-				}
-			} else if err == nil {
-				fmt.Fprintln(Errs, "String expected.")
-			} else {
-				fmt.Fprintln(Errs, err)
+		if ctx.MatchNumber() {
+			start, err = strconv.Atoi(ctx.Token)
+			if err == nil && ctx.Match(",") {
+				if !ctx.MatchNumber() { return errors.New("Step expected") }
+				step, err = strconv.Atoi(ctx.Token)
 			}
-		} else {
-			err = ctx.DispatchStatement()
 		}
-		if err != nil { fmt.Fprintln(Errs, err) }
-		fmt.Fprint(Outs, "> ")
+		if err != nil {
+			return err
+		} else if start <= 0 || step <= 0 {
+			return errors.New("Line numbers must be positive")
+		}
+		seen := len(ctx.Warnings)
+		done := ctx.Renumber(start, step)
+		for _, w := range ctx.Warnings[seen:] {
+			fmt.Fprintln(ctx.Stdout(), w)
+		}
+		if done { fmt.Fprintln(ctx.Stdout(), "Program renumbered.") }
+		return nil
+	},
+	// List the warnings collected so far, then forget them.
+	"warnings": func (ctx *Context) error {
+		for _, w := range ctx.Warnings {
+			fmt.Fprintln(ctx.Stdout(), w)
+		}
+		ctx.Warnings = nil
+		return nil
+	},
+	"stack": func (ctx *Context) error {
+		ctx.StackReport(ctx.Stdout())
+		return nil
+	},
+	"history": func (ctx *Context) error {
+		for i, line := range ctx.history {
+			fmt.Fprintf(ctx.Stdout(), "%d\t%s\n", i + 1, line)
+		}
+		return nil
+	},
+	// LIST PRETTY indents the bodies of loops.
+	"list": func (ctx *Context) error {
+		depths := make(map[int]int)
+		if ctx.MatchNocase("pretty") {
+			depths, _ = ctx.Program.Nesting()
+		}
+		for _, i := range ctx.Program.LineNumbers() {
+			indent := strings.Repeat("  ", depths[i])
+			fmt.Fprintf(ctx.Stdout(), "%d\t%s%s\n", i, indent, ctx.Program[i])
+		}
+		return nil
+	},
+	"dump": func (ctx *Context) error { return ctx.ExportJSON(ctx.Stdout()) },
+	"profile": (*Context).ParseProfile,
+	"coverage": func (ctx *Context) error {
+		lines, err := ctx.Uncovered()
+		for _, i := range lines {
+			fmt.Fprintf(ctx.Stdout(), "%d\t%s\n", i, ctx.Program[i])
+		}
+		return err
+	},
+	"parse": func (ctx *Context) error {
+		tree, err := ctx.ParseTree()
+		if err == nil && !ctx.MatchEol() {
+			err = errors.New(
+				"End of statement expected, found: " + ctx.Line[ctx.Cursor:])
+		}
+		if err == nil { fmt.Fprintln(ctx.Stdout(), tree) }
+		return err
+	},
+	"run": func (ctx *Context) error {
+		if !ctx.MatchNumber() { return ctx.RunProgram() }
+		ln, err := strconv.Atoi(ctx.Token)
+		if err != nil { return err }
+		return ctx.RunFrom(ln)
+	},
+	"continue": (*Context).ContinueProgram,
+	"clear": func (ctx *Context) error {
+		if !ctx.MatchEol() { return ctx.ParseUndef() }
+		ctx.ClearVariables()
+		return nil
+	},
+	"new": func (ctx *Context) error { ctx.Program = make(Program); return nil },
+	"delete": func (ctx *Context) error {
+		if !ctx.MatchNumber() { return errors.New("Line # expected") }
+		ln, _ := strconv.Atoi(ctx.Token)
+		delete(ctx.Program, ln)
+		return nil
+	},
+	"load": func (ctx *Context) error {
+		fn, err := ctx.ParseFilename()
+		if err == nil { err = ctx.LoadFile(fn) }
+		if err == nil { fmt.Fprintln(ctx.Stdout(), "File loaded.") }
+		return err
+	},
+	"save": func (ctx *Context) error {
+		fn, err := ctx.ParseFilename()
+		if err == nil { err = ctx.SaveFile(fn) }
+		if err == nil { fmt.Fprintln(ctx.Stdout(), "File saved.") }
+		return err
+	},
+}
+
+// Handle one line of input like the command loop: store it in the program
+// if it starts with a line number, else run it as a command or statement.
+// Failing that, it's taken for an expression, and the result printed.
+func (ctx *Context) ExecLine(line string) error {
+	ctx.Line = line
+	ctx.Cursor = 0
+	ctx.line_num = 0
+	if len(ctx.Line) == 0 {
+		return nil
+	} else if ctx.HasLineNumber() {
+		return ctx.ParseLine()
+	} else if ctx.MatchAssignment() {
+		return ctx.ParseLet()
+	} else if !ctx.MatchKeyword() {
+		return ctx.ParseCalculation()
+	} else if command, ok := Commands[ctx.Token]; ok {
+		return command(ctx)
+	} else if IsStatement(ctx.Token) {
+		return ctx.DispatchStatement()
+	} else if err := ctx.ParseCalculation(); err == nil {
+		return nil
+	} else if word, ok := StatementLike(ctx.Line); ok {
+		return errors.New("Unknown statement: " + word)
+	} else {
+		return err
 	}
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintln(Errs, "Error on input: ", err)
+}
+
+// Whether text looks like a statement, a word followed by an operand, as
+// in "prnt 5" (a mistyped PRINT) rather than an expression like "x + 1".
+func StatementLike(text string) (string, bool) {
+	scan := Context{Line: text}
+	if !scan.MatchVarname() { return "", false }
+	end := scan.Cursor
+	scan.SkipWhitespace()
+	if scan.Cursor == end || scan.Cursor == len(text) { return "", false }
+	c := text[scan.Cursor]
+	return scan.Token, c == '"' || c == '.' || hasAlnumAt(text, scan.Cursor)
+}
+
+// A line number is followed by a statement or nothing, so "2*3" isn't one.
+func (ctx *Context) HasLineNumber() bool {
+	if !hasDigitAt(ctx.Line, 0) { return false }
+	rest := strings.TrimLeft(ctx.Line, "0123456789")
+	rest = strings.TrimSpace(rest)
+	return rest == "" || hasLetterAt(rest, 0)
+}
+
+// Evaluate all of Context.Line as an expression, calculator style.
+func (ctx *Context) ParseCalculation() error {
+	ctx.Cursor = 0
+	value, err := ctx.ParseExpression()
+	if err != nil { return err }
+	if !ctx.MatchEol() {
+		return errors.New(
+			"End of expression expected, found: " + ctx.Line[ctx.Cursor:])
 	}
+	fmt.Fprintln(ctx.Stdout(), ctx.FormatNumber(value))
+	return nil
 }
 
-func main() {
-	basic := Context{Variables: make(Variables), Program: make(Program)}
-	
-	if len(os.Args) > 1 {
-		for _, i := range os.Args[1:] {
-			err := basic.LoadFile(i)
-			if err != nil { fmt.Fprintln(Errs, err); return }
+func (ctx *Context) ParseFilename() (string, error) {
+	fn, ok, err := ctx.ParseStringLiteral()
+	if err == nil && !ok {
+		err = errors.New("String expected.")
+	}
+	return fn, err
+}
+
+func (ctx *Context) CommandLoop(banner string) {
+	fmt.Fprintln(ctx.Stdout(), banner);
+	fmt.Fprint(ctx.Stdout(), "> ")
+	pending := ""
+	for {
+		line, ok, err := ctx.ReadLine()
+		if err != nil {
+			fmt.Fprintln(ctx.Stderr(), "Error on input: ", err)
+			break
+		} else if !ok {
+			break
+		}
+		text, continued := ContinuedLine(line)
+		line = JoinLines(pending, text)
+		if continued {
+			pending = line
+			fmt.Fprint(ctx.Stdout(), "_ ")
+			continue
 		}
-		basic.RunProgram()
-		if !basic.stop { return }
+		pending = ""
+		ctx.Remember(line)
+		err = ctx.ExecLine(line)
+		if err == ErrBye {
+			break
+		} else if err != nil {
+			fmt.Fprintln(ctx.Stderr(), err)
+		}
+		fmt.Fprint(ctx.Stdout(), "> ")
 	}
+}
+
+const Banner = "Tinycat BASIC v1.1 READY\nType BYE to quit."
 
-	basic.CommandLoop("Tinycat BASIC v1.1 READY\nType BYE to quit.")
+// Given a program to run, followed by arguments for it, run it and exit
+// with its ExitCode, or 1 if it fails. Otherwise, or with -i, use the
+// command loop.
+func main() {
+	interactive := flag.Bool("i", false,
+		"use the command loop after running the program")
+	flag.Parse()
+	basic := NewContext()
+	
+	if flag.NArg() == 0 {
+		basic.CommandLoop(Banner)
+		return
+	}
+	basic.Args = flag.Args()[1:]
+	err := basic.LoadFile(flag.Arg(0))
+	if err == nil {
+		err = basic.RunProgram()
+	}
+	if err != nil {
+		fmt.Fprintln(basic.Err, err)
+	}
+	if *interactive {
+		basic.CommandLoop(Banner)
+	} else if err != nil {
+		os.Exit(1)
+	} else {
+		os.Exit(basic.ExitCode)
+	}
 }
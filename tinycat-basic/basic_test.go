@@ -0,0 +1,1471 @@
+package main
+
+import (
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Run a program with RunCaptured, failing the test on any error.
+func run(t *testing.T, source, input string) string {
+	t.Helper()
+	out, _, err := RunCaptured(source, input)
+	if err != nil {
+		t.Fatalf("unexpected error: %v\noutput so far:\n%s", err, out)
+	}
+	return out
+}
+
+// Run a program with RunCaptured, expecting it to fail with an error
+// containing the given text.
+func runFailing(t *testing.T, source, input, message string) {
+	t.Helper()
+	_, _, err := RunCaptured(source, input)
+	if err == nil {
+		t.Fatalf("expected an error containing %q, got none", message)
+	} else if !strings.Contains(err.Error(), message) {
+		t.Fatalf("expected an error containing %q, got: %v", message, err)
+	}
+}
+
+func expect(t *testing.T, got, want string) {
+	t.Helper()
+	if got != want {
+		t.Errorf("got output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestPrint(t *testing.T) {
+	out := run(t, `10 print "Hello, world!"
+20 let x = 6
+30 print "x * 7 = ", x * 7
+40 print 1;
+50 print 2
+`, "")
+	expect(t, out, "Hello, world!\nx * 7 = 42\n12\n")
+}
+
+func TestInput(t *testing.T) {
+	out := run(t, `10 input "Your age: "; age
+20 print "Next year you'll be ", age + 1
+30 input a, b
+40 print a + b
+`, "41\n2, 3\n")
+	expect(t, out, "Your age: Next year you'll be 42\n5\n")
+}
+
+func TestInputRedo(t *testing.T) {
+	out := run(t, `10 input n
+20 print n * 2
+`, "abc\n21\n")
+	expect(t, out, "?Redo from start\n42\n")
+}
+
+func TestRunCapturedIsRepeatable(t *testing.T) {
+	source := "10 print rnd()\n20 print timer()\n"
+	expect(t, run(t, source, ""), run(t, source, ""))
+}
+
+func TestForLeftByGoto(t *testing.T) {
+	out := run(t, `5 n = 0
+10 for i = 1 to 10
+30 if i = 2 then goto 50
+40 next i
+50 n = n + 1
+60 if n < 2000 then goto 10
+70 print n
+`, "")
+	expect(t, out, "2000\n")
+}
+
+func TestEmptyLoopInsideNextList(t *testing.T) {
+	out := run(t, `10 for i = 1 to 3
+20 for j = 5 to 1
+30 print "never"
+40 next j, i
+50 print "done ", i
+`, "")
+	expect(t, out, "done 4\n")
+}
+
+func TestExitInsideNextList(t *testing.T) {
+	out := run(t, `10 for i = 1 to 3
+20 for j = 1 to 3
+30 if j = 2 then exit for
+40 print i; " "; j
+50 next j, i
+60 print "done"
+`, "")
+	expect(t, out, "1 1\n2 1\n3 1\ndone\n")
+}
+
+func TestIterateOuterLoopOfNextList(t *testing.T) {
+	out := run(t, `10 for i = 1 to 3
+20 if i = 2 then iterate
+30 for j = 1 to 2
+40 print i; " "; j
+50 next j, i
+`, "")
+	expect(t, out, "1 1\n1 2\n3 1\n3 2\n")
+}
+
+func TestRepeatCounts(t *testing.T) {
+	expect(t, run(t, `10 print "[", space$(3), string$(2.5, "x"), "]"
+`, ""), "[   xx]\n")
+	expect(t, run(t, `10 print "[", space$(5), "]", string$(3, asc("-")), string$(2, 42)
+`, ""), "[     ]---**\n")
+	runFailing(t, "10 print space$(0/0)\n", "", "Bad count in call to space$")
+	runFailing(t, "10 print string$(2^70, \"x\")\n", "",
+		"Count too large in call to string$")
+	runFailing(t, "10 print space$(-1/0)\n", "", "Negative count")
+}
+
+func TestEvalSafeModByZero(t *testing.T) {
+	for _, expr := range []string{"mod(1, 0)", "mod(5, 0.5)"} {
+		value, err := EvalSafe(expr, nil)
+		if err != nil || !math.IsNaN(value) {
+			t.Errorf("EvalSafe(%q) = %v, %v; want NaN", expr, value, err)
+		}
+	}
+	if value, err := EvalSafe("mod(7, 3)", nil); value != 1 || err != nil {
+		t.Errorf("EvalSafe(\"mod(7, 3)\") = %v, %v; want 1", value, err)
+	}
+}
+
+// Run lines through ExecLine, as typed at the prompt, stopping at the
+// first error.
+func execLines(t *testing.T, lines ...string) (string, error) {
+	t.Helper()
+	var out strings.Builder
+	ctx := NewContext()
+	ctx.In = strings.NewReader("")
+	ctx.Out = &out
+	ctx.Err = &out
+	for _, line := range lines {
+		if err := ctx.ExecLine(line); err != nil {
+			return out.String(), err
+		}
+	}
+	return out.String(), nil
+}
+
+func TestRenumberGosubWithArgs(t *testing.T) {
+	out, err := execLines(t,
+		"10 gosub 50 (1)",
+		"20 end",
+		"50 print param(1)",
+		"60 return",
+		"renum 100, 100",
+		"list",
+		"run")
+	if err != nil { t.Fatal(err) }
+	expect(t, out, "Program renumbered.\n" +
+		"100\tgosub 300 (1)\n200\tend\n300\tprint param(1)\n" +
+		"400\treturn\n1\n")
+}
+
+func TestGotoLabelAfterRenumber(t *testing.T) {
+	_, err := execLines(t,
+		"10 stop",
+		"20 print \"foo\"",
+		"run",
+		"15 bar: print \"bar\"",
+		"renum",
+		"goto bar",
+		"continue")
+	if err == nil || !strings.Contains(err.Error(), "Label not found: bar") {
+		t.Errorf("expected a missing label, got: %v", err)
+	}
+	out, err := execLines(t,
+		"10 goto bar",
+		"20 print \"skipped\"",
+		"30 bar: print \"bar\"",
+		"renum 100, 100",
+		"run")
+	if err != nil { t.Fatal(err) }
+	expect(t, out, "Program renumbered.\nbar\n")
+
+	out, err = execLines(t,
+		"10 stop",
+		"20 print \"foo\"",
+		"run",
+		"renum 100, 100",
+		"continue")
+	if err != nil { t.Fatal(err) }
+	expect(t, out, "Program renumbered.\nfoo\n")
+}
+
+func TestLabelOnlyProgram(t *testing.T) {
+	out := run(t, `let i = 0
+top: let i = i + 1
+print i
+if i < 3 then goto top
+
+print "done"
+`, "")
+	expect(t, out, "1\n2\n3\ndone\n")
+}
+
+// Write files into a fresh directory, then load and run the first one.
+func runFiles(t *testing.T, files ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for i := 0; i < len(files); i += 2 {
+		fn := filepath.Join(dir, files[i])
+		if err := os.WriteFile(fn, []byte(files[i + 1]), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var out strings.Builder
+	ctx := NewContext()
+	ctx.Out = &out
+	ctx.Err = &out
+	err := ctx.LoadFile(filepath.Join(dir, files[0]))
+	if err == nil { err = ctx.RunProgram() }
+	if err != nil { t.Fatalf("unexpected error: %v", err) }
+	return out.String()
+}
+
+func TestIncludeLabelOnlyFile(t *testing.T) {
+	lib := "greet:\n  print \"hello\"\n  return\n"
+	expect(t, runFiles(t,
+		"main.bas", "include \"lib.bas\"\ngosub greet\nend\n",
+		"lib.bas", lib), "hello\n")
+	expect(t, runFiles(t,
+		"main.bas", "include \"lib.bas\"\n10 gosub greet\n20 end\n",
+		"lib.bas", lib), "hello\n")
+}
+
+func TestAssignmentsLookingLikeKeywords(t *testing.T) {
+	out := run(t, `10 do
+20 exit do
+30 loop_n = 5
+40 loop until 1
+50 select case 2
+60 case 2
+70 case_n = 5
+80 print "two"
+90 end select
+100 print case_n
+`, "")
+	expect(t, out, "two\n5\n")
+	ctx := NewContext()
+	ctx.Load(strings.NewReader("10 do\n20 loop_n = 5\n30 loop until 1\n"))
+	if len(ctx.Warnings) > 0 {
+		t.Errorf("unexpected warnings: %v", ctx.Warnings)
+	}
+}
+
+// Contexts used to be made as literals, without NewContext.
+func TestContextLiteral(t *testing.T) {
+	saved := Outs
+	defer func () { Outs = saved }()
+	file, err := os.CreateTemp(t.TempDir(), "out")
+	if err != nil { t.Fatal(err) }
+	Outs = file
+	ctx := Context{Variables: make(Variables), Program: make(Program)}
+	ctx.Program[10] = "print 6 * 7"
+	ctx.Program[20] = "for i = 1 to 2"
+	ctx.Program[30] = "next i"
+	if err := ctx.RunProgram(); err != nil { t.Fatal(err) }
+	file.Close()
+	data, _ := os.ReadFile(file.Name())
+	expect(t, string(data), "42\n")
+}
+
+func TestDefintLoopVariable(t *testing.T) {
+	out := run(t, `10 defint i
+20 for i = 1 to 2 step 1.5
+30 print i
+40 next i
+50 print i
+`, "")
+	expect(t, out, "1\n2\n3\n")
+	runFailing(t, "10 defint i\n20 for i = 1 to 2 step 0.5\n30 next i\n", "",
+		"Infinite loop")
+	out = run(t, `10 defint i
+20 for i = 1.5 to 1
+30 print "body"; i
+40 next i
+`, "")
+	expect(t, out, "body1\n")
+}
+
+func TestVarOrderStaysBounded(t *testing.T) {
+	ctx := NewContext()
+	ctx.Out = &strings.Builder{}
+	err := ctx.Load(strings.NewReader(`10 for n = 1 to 5000
+20 gosub 100
+30 next n
+40 end
+100 local tmp
+110 tmp = n
+120 return
+`))
+	if err == nil { err = ctx.RunProgram() }
+	if err != nil { t.Fatal(err) }
+	if len(ctx.varOrder) > 3 {
+		t.Errorf("varOrder grew to %d names", len(ctx.varOrder))
+	}
+}
+
+func TestCheckSyntaxTrailingText(t *testing.T) {
+	ctx := NewContext()
+	ctx.Program[10] = "let x = 5 6"
+	ctx.Program[20] = "goto 10 junk"
+	ctx.Program[30] = "select case x"
+	ctx.Program[40] = "case 1, 2 to 3, is > 4"
+	ctx.Program[50] = "end select"
+	errs := ctx.CheckSyntax()
+	if len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got %v", errs)
+	}
+	for i, ln := range []string{"line 10", "line 20"} {
+		if !strings.Contains(errs[i].Error(), ln) {
+			t.Errorf("expected an error in %s, got: %v", ln, errs[i])
+		}
+	}
+}
+
+func TestCheckSyntaxDoesNotEvaluate(t *testing.T) {
+	for _, source := range []string{
+		"10 gosub 100 (3)\n20 end\n100 print param(1)\n110 return\n",
+		"10 s = 2\n20 for i = 1 to 10 step s\n30 next i\n",
+		"10 n = 2\n20 print instr(n, \"abc\", \"c\")\n",
+		"10 print argv$(argc())\n",
+		"10 print environ$(\"HOME\")\n",
+	} {
+		ctx := NewContext()
+		ctx.AllowEnviron = true
+		if err := ctx.Load(strings.NewReader(source)); err != nil {
+			t.Fatal(err)
+		}
+		if errs := ctx.CheckSyntax(); len(errs) > 0 {
+			t.Errorf("%q: unexpected errors %v", source, errs)
+		}
+	}
+}
+
+func TestCheckSyntaxAfterStopAndSelect(t *testing.T) {
+	ctx := NewContext()
+	ctx.Load(strings.NewReader(`10 stop
+20 wait x > 1
+30 select case x
+40 case 1
+50 print "one"
+60 case else
+70 end select
+80 wait x < 1
+`))
+	if errs := ctx.CheckSyntax(); len(errs) > 0 {
+		t.Errorf("unexpected errors %v", errs)
+	}
+}
+
+func TestTruthNamesInParentheses(t *testing.T) {
+	out := run(t, `10 option truth names
+20 print 1 > 0
+30 print (1 > 0)
+40 print ((2 < 1))
+50 print (1 > 0) + (2 > 1)
+60 print abs(1 > 0)
+`, "")
+	expect(t, out, "TRUE\nTRUE\nFALSE\n-2\n1\n")
+}
+
+func TestCalculatorAtPrompt(t *testing.T) {
+	out, err := execLines(t, "2*3", "x = 4", "x + 1", "max_value = 2", "max_value")
+	if err != nil { t.Fatal(err) }
+	expect(t, out, "6\n5\n2\n")
+	for line, message := range map[string]string{
+		"prnt 5": "Unknown statement: prnt",
+		"prnt \"hi\"": "Unknown statement: prnt",
+		"y + 1": "Variable not found: y",
+	} {
+		_, err := execLines(t, line)
+		if err == nil || err.Error() != message {
+			t.Errorf("%s: expected %q, got: %v", line, message, err)
+		}
+	}
+}
+
+func TestAssignmentWithoutLet(t *testing.T) {
+	out, err := execLines(t, "x = 5", "print x", "10 y = x * 2", "20 print y",
+		"run")
+	if err != nil { t.Fatal(err) }
+	expect(t, out, "5\n10\n")
+}
+
+func TestReplacedLineWarning(t *testing.T) {
+	ctx := NewContext()
+	ctx.Out = &strings.Builder{}
+	ctx.Load(strings.NewReader("10 print 1\n20 print 2\n"))
+	if err := ctx.RunProgram(); err != nil { t.Fatal(err) }
+	ctx.Load(strings.NewReader("10 print 3\n"))
+	want := []Warning{{0, "Line 10 replaced"}}
+	if len(ctx.Warnings) != 1 || ctx.Warnings[0] != want[0] {
+		t.Errorf("got warnings %v, want %v", ctx.Warnings, want)
+	}
+}
+
+func TestNestingWarningsOnReload(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "prog.bas")
+	if err := os.WriteFile(fn, []byte("10 next i\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := NewContext()
+	ctx.Out = &strings.Builder{}
+	ctx.Err = &strings.Builder{}
+	for i := 0; i < 2; i++ {
+		if err := ctx.LoadFile(fn); err != nil { t.Fatal(err) }
+	}
+	nesting := 0
+	for _, w := range ctx.Warnings {
+		if w.Line == 10 { nesting++ }
+	}
+	if nesting != 1 {
+		t.Errorf("expected one warning for line 10, got %v", ctx.Warnings)
+	}
+}
+
+func TestFrameUsesClock(t *testing.T) {
+	now := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	slept := make([]time.Duration, 0)
+	ctx := NewContext()
+	ctx.Now = func () time.Time { return now }
+	ctx.OnSleep = func (d time.Duration) {
+		slept = append(slept, d)
+		now = now.Add(d)
+	}
+	ctx.Load(strings.NewReader(`10 for i = 1 to 3
+20 frame 10
+30 next i
+`))
+	if err := ctx.RunProgram(); err != nil { t.Fatal(err) }
+	want := 100 * time.Millisecond
+	if len(slept) != 2 || slept[0] != want || slept[1] != want {
+		t.Errorf("slept %v, want two frames of %v", slept, want)
+	}
+}
+
+func TestWaitStepLimit(t *testing.T) {
+	ctx := NewContext()
+	ctx.Out = &strings.Builder{}
+	ctx.MaxSteps = 50
+	ctx.OnSleep = func (time.Duration) {}
+	ctx.Load(strings.NewReader("10 wait 1\n20 wait 0\n"))
+	err := ctx.RunProgram()
+	if err == nil || !strings.Contains(err.Error(), "Step limit exceeded") {
+		t.Errorf("expected the step limit, got: %v", err)
+	}
+}
+
+func TestWaitForTimer(t *testing.T) {
+	var out strings.Builder
+	now := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	slept := time.Duration(0)
+	ctx := NewContext()
+	ctx.Out = &out
+	ctx.Now = func () time.Time { return now }
+	ctx.OnSleep = func (d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+	ctx.Load(strings.NewReader(`10 t = timer() + 0.5
+20 wait timer() >= t
+30 print "ok"
+`))
+	if err := ctx.RunProgram(); err != nil { t.Fatal(err) }
+	expect(t, out.String(), "ok\n")
+	if slept < 500 * time.Millisecond || slept > 510 * time.Millisecond {
+		t.Errorf("slept %v, want about half a second", slept)
+	}
+}
+
+func TestPrintAt(t *testing.T) {
+	out := run(t, `10 print at(3, 5); "here"
+20 at = 2
+30 print at
+`, "")
+	expect(t, out, "\x1b[3;5Hhere\n2\n")
+	out = run(t, `10 print at(2, 3)
+20 print "x"
+30 print at(1, 1);
+40 print "y"
+`, "")
+	expect(t, out, "\x1b[2;3H\nx\n\x1b[1;1Hy\n")
+}
+
+func TestForZeroTimes(t *testing.T) {
+	out := run(t, `10 for i = 5 to 1
+20 print "never"
+30 next i
+40 for j = 1 to 3 step -1
+50 print "never"
+60 next j
+70 print "done"
+`, "")
+	expect(t, out, "done\n")
+}
+
+func TestSelectCase(t *testing.T) {
+	out := run(t, `10 for x = 1 to 6
+20 select case x
+30 case 1
+40 print "one"
+50 case 2 to 3
+60 print "two-three"
+70 case is >= 5
+80 select case x
+90 case 5
+100 print "five"
+110 case else
+120 print "big"
+130 end select
+140 case else
+150 print "else"
+160 end select
+170 next x
+`, "")
+	expect(t, out, "one\ntwo-three\ntwo-three\nelse\nfive\nbig\n")
+}
+
+func TestLabeledEndSelect(t *testing.T) {
+	out := run(t, `10 x = 3
+20 select case x
+30 case 1
+35 print "one"
+40 done: end select
+50 print "after"
+`, "")
+	expect(t, out, "after\n")
+}
+
+func TestLabels(t *testing.T) {
+	out := run(t, `10 gosub greet
+20 goto done
+30 print "skipped"
+40 greet: print "hello"
+50 return
+60 done:
+70 print "done"
+`, "")
+	expect(t, out, "hello\ndone\n")
+	runFailing(t, "10 goto nowhere\n", "", "Label not found: nowhere")
+}
+
+func TestComputedTargets(t *testing.T) {
+	out := run(t, `10 n = 2
+20 goto n * 100 + 0.4
+100 print "wrong"
+200 print "two hundred"
+`, "")
+	expect(t, out, "two hundred\n")
+	runFailing(t, "10 goto 0 - 10\n", "", "Negative line number")
+}
+
+func TestStackDepthLimit(t *testing.T) {
+	runFailing(t, "10 gosub 10\n", "", "Stack overflow")
+}
+
+func TestLineEditing(t *testing.T) {
+	ctx := NewContext()
+	ctx.SetLine(20, "  print 2  ")
+	ctx.SetLine(10, "print 1")
+	ctx.SetLine(30, "print 3")
+	ctx.DeleteLine(30)
+	lines := ctx.Lines()
+	want := []ProgramLine{{10, "print 1"}, {20, "print 2"}}
+	if len(lines) != len(want) || lines[0] != want[0] || lines[1] != want[1] {
+		t.Errorf("got %v, want %v", lines, want)
+	}
+}
+
+func TestParseStringLiteral(t *testing.T) {
+	ctx := Context{Line: ` "a b" rest "c"`}
+	text, ok, err := ctx.ParseStringLiteral()
+	if text != "a b" || !ok || err != nil {
+		t.Errorf("got %q, %v, %v", text, ok, err)
+	}
+	if !ctx.MatchVarname() || ctx.Token != "rest" {
+		t.Fatalf("expected the variable after the string, got %q", ctx.Token)
+	}
+	later, _, _ := ctx.ParseStringLiteral()
+	if text != "a b" || later != "c" {
+		t.Errorf("got %q and %q after further matches", text, later)
+	}
+	ctx = Context{Line: "x"}
+	if _, ok, err := ctx.ParseStringLiteral(); ok || err != nil {
+		t.Errorf("expected no string, got %v, %v", ok, err)
+	}
+	ctx = Context{Line: `"open`}
+	if _, _, err := ctx.ParseStringLiteral(); err == nil {
+		t.Errorf("expected an unterminated string error")
+	}
+}
+
+func TestOptionAngle(t *testing.T) {
+	out := run(t, `10 option angle degrees
+20 print sin(90); " "; cos(180)
+30 option angle radians
+40 print cos(0)
+`, "")
+	expect(t, out, "1 -1\n1\n")
+}
+
+func TestDefintDefdbl(t *testing.T) {
+	out := run(t, `10 defint a-c, x
+20 a = 2.7
+30 b = -1.5
+40 x = 0.5
+50 defdbl b
+60 b = 1.5
+70 d = 2.5
+80 print a; " "; b; " "; x; " "; d
+`, "")
+	expect(t, out, "2 1.5 0 2.5\n")
+}
+
+func TestOptionTruth(t *testing.T) {
+	out := run(t, `10 print 1 > 0
+20 option truth names
+30 print 1 > 0; " "; 1 < 0; " "; not 0; " "; 1 + 1
+40 option truth numbers
+50 print 1 > 0
+`, "")
+	expect(t, out, "-1\nTRUE FALSE TRUE 2\n-1\n")
+}
+
+func TestPrintFormat(t *testing.T) {
+	var out strings.Builder
+	ctx := NewContext()
+	ctx.Out = &out
+	ctx.PrintFormat = "%.2f"
+	ctx.Load(strings.NewReader("10 print 1 / 3\n20 print 2\n"))
+	if err := ctx.RunProgram(); err != nil { t.Fatal(err) }
+	expect(t, out.String(), "0.33\n2.00\n")
+}
+
+func TestInstr(t *testing.T) {
+	out := run(t, `10 print instr("hello", "l"); " "; instr(4, "hello", "l")
+20 print instr("hello", "z"); " "; instr("", "")
+`, "")
+	expect(t, out, "3 4\n0 0\n")
+	out = run(t, `10 print instr(3, "abcdef", ""); " "; instr(6, "abcdef", "")
+20 print instr(7, "abcdef", ""); " "; instr(9, "abcdef", "x")
+`, "")
+	expect(t, out, "3 6\n0 0\n")
+}
+
+func TestCaseFunctions(t *testing.T) {
+	out := run(t, `10 print ucase$("abc"); lcase$("DeF")
+`, "")
+	expect(t, out, "ABCdef\n")
+	out = run(t, `10 print ucase$("straße"); " "; lcase$("ÄÖÜ"); " "; ucase$("éa")
+`, "")
+	expect(t, out, "STRAßE äöü ÉA\n")
+	runFailing(t, "10 print ucase$(1)\n", "", "ucase$")
+}
+
+func TestTrimFunctions(t *testing.T) {
+	out := run(t, `10 print "["; trim$("  x "); "|"; ltrim$("  y "); "|"; rtrim$(" z  "); "]"
+`, "")
+	expect(t, out, "[x|y | z]\n")
+	out = run(t, "10 print \"[\"; trim$(\"\t x \t\"); \"|\"; ltrim$(\"\t\ty\t\"); " +
+		"\"|\"; rtrim$(\"\tz \t\"); \"]\"\n", "")
+	expect(t, out, "[x|y\t|\tz]\n")
+}
+
+func TestAsc(t *testing.T) {
+	expect(t, run(t, "10 print asc(\"A\"); \" \"; asc(\"é\")\n", ""), "65 233\n")
+	runFailing(t, "10 print asc(\"\")\n", "", "Empty string in call to asc")
+}
+
+func TestProgramHash(t *testing.T) {
+	ctx := NewContext()
+	ctx.SetLine(10, "print 1")
+	before := ctx.ProgramHash()
+	if ctx.ProgramHash() != before {
+		t.Errorf("hash changed without any edit")
+	}
+	ctx.SetLine(10, "print 2")
+	if ctx.ProgramHash() == before {
+		t.Errorf("hash didn't change after an edit")
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	ctx := NewContext()
+	ctx.SetLine(10, "print \"a\"")
+	ctx.SetLine(20, "end")
+	var data strings.Builder
+	if err := ctx.ExportJSON(&data); err != nil { t.Fatal(err) }
+	copied := NewContext()
+	if err := copied.ImportJSON(strings.NewReader(data.String())); err != nil {
+		t.Fatal(err)
+	}
+	if copied.ProgramHash() != ctx.ProgramHash() {
+		t.Errorf("program changed on the way:\n%s", data.String())
+	}
+	if err := copied.ImportJSON(strings.NewReader("[1]")); err == nil {
+		t.Errorf("expected an error for bad JSON")
+	}
+}
+
+func TestKeywordsAndFunctionNames(t *testing.T) {
+	keywords := Keywords()
+	if len(keywords) != len(statements) || !sort.StringsAreSorted(keywords) {
+		t.Errorf("bad keyword list: %v", keywords)
+	}
+	names := FunctionNames()
+	if !sort.StringsAreSorted(names) {
+		t.Errorf("function names not sorted: %v", names)
+	}
+	for _, name := range []string{"sin", "rnd", "ucase$"} {
+		if i := sort.SearchStrings(names, name); i == len(names) ||
+				names[i] != name {
+			t.Errorf("%s missing from FunctionNames", name)
+		}
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	out, err := execLines(t, "parse 1 + 2 * 3 ^ 2 > 4 and not x")
+	if err != nil { t.Fatal(err) }
+	expect(t, out, "(((1 + (2 * (3 ^ 2))) > 4) and (not x))\n")
+	out, err = execLines(t, `parse instr(ucase$("abc"), "B") + 1`)
+	if err != nil { t.Fatal(err) }
+	expect(t, out, `(instr(ucase$("abc"), "B") + 1)` + "\n")
+	for line, message := range map[string]string{
+		"parse 1 2 junk": "End of statement expected, found: 2 junk",
+		`parse foo$("a")`: "No such function: foo$",
+	} {
+		_, err = execLines(t, line)
+		if err == nil || err.Error() != message {
+			t.Errorf("%s: expected %q, got: %v", line, message, err)
+		}
+	}
+}
+
+func TestPrintSideBySide(t *testing.T) {
+	out := run(t, `10 a = 1
+20 b = 3
+30 print a b (-2) "x" 4
+40 print a b -2
+50 print a; b
+`, "")
+	expect(t, out, "1 3-2x 4\n1 1\n13\n")
+}
+
+func TestConsoleSize(t *testing.T) {
+	out := run(t, "10 print conwidth(); \" \"; conheight()\n", "")
+	expect(t, out, "80 24\n")
+}
+
+func TestRelationalAliases(t *testing.T) {
+	out := run(t, `10 print 1 =< 2; 2 => 3; 1 >< 2
+20 if 2 => 2 then print "yes"
+`, "")
+	expect(t, out, "-10-1\nyes\n")
+}
+
+func TestTrace(t *testing.T) {
+	out, errs, err := RunCaptured(`10 tron
+20 print 1
+30 troff
+40 print 2
+`, "")
+	if err != nil { t.Fatal(err) }
+	expect(t, out, "1\n2\n")
+	expect(t, errs, "[20]\n[30]\n")
+}
+
+func TestProfile(t *testing.T) {
+	out, err := execLines(t,
+		"10 for i = 1 to 2",
+		"20 next i",
+		"profile on",
+		"run",
+		"profile report")
+	if err != nil { t.Fatal(err) }
+	expect(t, out, "2\t20\tnext i\n1\t10\tfor i = 1 to 2\n")
+}
+
+func TestCoverage(t *testing.T) {
+	out, err := execLines(t,
+		"10 if 0 then 30",
+		"20 end",
+		"30 print \"x\"",
+		"profile on",
+		"run",
+		"coverage")
+	if err != nil { t.Fatal(err) }
+	expect(t, out, "30\tprint \"x\"\n")
+	if _, err := execLines(t, "coverage"); err == nil {
+		t.Errorf("expected an error without a profile")
+	}
+}
+
+func TestSleepHook(t *testing.T) {
+	var slept time.Duration
+	ctx := NewContext()
+	ctx.OnSleep = func (d time.Duration) { slept += d }
+	ctx.Load(strings.NewReader("10 sleep 1.5\n20 sleep 0\n"))
+	if err := ctx.RunProgram(); err != nil { t.Fatal(err) }
+	if slept != 1500 * time.Millisecond {
+		t.Errorf("slept %v, want 1.5s", slept)
+	}
+	runFailing(t, "10 sleep -1\n", "", "Negative sleep time")
+}
+
+func TestExecLine(t *testing.T) {
+	out, err := execLines(t, "", "10 print 1", "print 2", "run")
+	if err != nil { t.Fatal(err) }
+	expect(t, out, "2\n1\n")
+}
+
+func TestCommandsTable(t *testing.T) {
+	Commands["hello"] = func (ctx *Context) error {
+		_, err := ctx.Stdout().Write([]byte("hi\n"))
+		return err
+	}
+	defer delete(Commands, "hello")
+	out, err := execLines(t, "hello")
+	if err != nil { t.Fatal(err) }
+	expect(t, out, "hi\n")
+	if _, err := execLines(t, "bye"); err != ErrBye {
+		t.Errorf("expected ErrBye, got: %v", err)
+	}
+}
+
+func TestRunFromLine(t *testing.T) {
+	out, err := execLines(t, "10 print 1", "20 print 2", "run 20")
+	if err != nil { t.Fatal(err) }
+	expect(t, out, "2\n")
+	if _, err := execLines(t, "10 print 1", "run 15"); err == nil {
+		t.Errorf("expected an error for a missing line")
+	}
+}
+
+func TestReturnValue(t *testing.T) {
+	out := run(t, `10 x = 4
+20 gosub 100
+30 print result
+40 end
+100 return x * x
+`, "")
+	expect(t, out, "16\n")
+}
+
+func TestDateTime(t *testing.T) {
+	out := run(t, "10 print date$(); \" \"; time$\n", "")
+	expect(t, out, "2000-01-01 00:00:00\n")
+}
+
+func TestTimerClock(t *testing.T) {
+	out := run(t, "10 print timer() = 946684800\n", "")
+	expect(t, out, "-1\n")
+}
+
+func TestUndef(t *testing.T) {
+	runFailing(t, "10 x = 1\n20 undef x\n30 print x\n", "",
+		"Variable not found: x")
+	out, err := execLines(t, "x = 1", "y = 2", "clear x", "y")
+	if err != nil { t.Fatal(err) }
+	expect(t, out, "2\n")
+	if _, err := execLines(t, "x = 1", "clear", "x"); err == nil {
+		t.Errorf("expected CLEAR to remove every variable")
+	}
+}
+
+func TestBool(t *testing.T) {
+	out := run(t, `10 print bool(5); " "; bool(0); " "; bool(1 > 0)
+20 print -((1 > 0) + (2 > 3) + (3 > 1))
+`, "")
+	expect(t, out, "1 0 1\n2\n")
+}
+
+func TestFmod(t *testing.T) {
+	out := run(t, "10 print fmod(5.5, 2); \" \"; fmod(-5.5, 2); \" \"; mod(7, 3)\n", "")
+	expect(t, out, "1.5 -1.5 1\n")
+}
+
+func TestFloorCeil(t *testing.T) {
+	out := run(t, "10 print floor(-1.5); \" \"; ceil(-1.5); \" \"; int(-1.5)\n", "")
+	expect(t, out, "-2 -1 -1\n")
+}
+
+func TestClampLerp(t *testing.T) {
+	out := run(t, `10 print clamp(5, 0, 3); " "; clamp(-1, 0, 3); " "; clamp(2, 0, 3)
+20 print lerp(0, 10, 0.25); " "; lerp(10, 20, 1)
+`, "")
+	expect(t, out, "3 0 2\n2.5 20\n")
+}
+
+func TestAngle(t *testing.T) {
+	out := run(t, `10 print angle(1, 0); " "; angle(0, 1) = pi / 2
+20 option angle degrees
+30 print angle(1, 1); " "; angle(-1, 0)
+`, "")
+	expect(t, out, "0 -1\n45 180\n")
+}
+
+func TestBareNext(t *testing.T) {
+	out := run(t, `10 for i = 1 to 2
+20 for j = 1 to 2
+30 print i; j
+40 next
+50 next
+`, "")
+	expect(t, out, "11\n12\n21\n22\n")
+	runFailing(t, "10 next\n", "", "NEXT without FOR.")
+	runFailing(t, "10 do\n20 loop until 1\n30 loop until 1\n", "",
+		"LOOP without DO.")
+}
+
+func TestNextList(t *testing.T) {
+	out := run(t, `10 for i = 1 to 2
+20 for j = 1 to 2
+30 print i; j
+40 next j, i
+`, "")
+	expect(t, out, "11\n12\n21\n22\n")
+	runFailing(t, "10 for i = 1 to 2\n20 for j = 1 to 2\n30 next i, j\n", "",
+		"NEXT i doesn't match FOR j")
+}
+
+func TestThenLineNumber(t *testing.T) {
+	out := run(t, `10 if 1 then 30
+20 print "skipped"
+30 print "jumped"
+`, "")
+	expect(t, out, "jumped\n")
+}
+
+func TestElse(t *testing.T) {
+	out := run(t, `10 x = 5
+20 if x > 3 then print "big" else print "small"
+30 if x < 3 then print "small" else print "big"
+40 if x < 3 then 60 else 70
+60 print "no"
+70 if 1 then if 0 then print "a" else print "b"
+`, "")
+	expect(t, out, "big\nbig\n")
+}
+
+func TestHelp(t *testing.T) {
+	out, err := execLines(t, "help print", "help SIN")
+	if err != nil { t.Fatal(err) }
+	expect(t, out, Help["print"] + "\n" + Help["sin"] + "\n")
+	if _, err := execLines(t, "help nope"); err == nil {
+		t.Errorf("expected an error for an unknown keyword")
+	}
+	for _, name := range append(Keywords(), FunctionNames()...) {
+		if _, ok := Help[name]; !ok { t.Errorf("no help for %s", name) }
+	}
+}
+
+func TestHistory(t *testing.T) {
+	ctx := NewContext()
+	for i := 0; i < HistorySize + 5; i++ {
+		ctx.Remember(strconv.Itoa(i))
+	}
+	ctx.Remember("")
+	history := ctx.History()
+	if len(history) != HistorySize || history[0] != "5" ||
+			history[len(history) - 1] != strconv.Itoa(HistorySize + 4) {
+		t.Errorf("unexpected history: %v", history)
+	}
+}
+
+func TestCommaSep(t *testing.T) {
+	var out strings.Builder
+	ctx := NewContext()
+	ctx.Out = &out
+	ctx.CommaSep = "\t"
+	ctx.Load(strings.NewReader("10 print 1, \"a\", 2\n"))
+	if err := ctx.RunProgram(); err != nil { t.Fatal(err) }
+	expect(t, out.String(), "1\ta\t2\n")
+}
+
+func TestNumberLimits(t *testing.T) {
+	out := run(t, `10 print maxnum() = 2 ^ 1023 * (2 - eps()); minnum() > 0
+20 print eps() = 2 ^ -52; 1 + eps() > 1
+`, "")
+	expect(t, out, "-1-1\n-1-1\n")
+}
+
+func TestNanInf(t *testing.T) {
+	out := run(t, `10 print isnan(0 / 0); isnan(1); isinf(-inf()); isinf(maxnum())
+20 print inf() > maxnum()
+`, "")
+	expect(t, out, "-10-10\n-1\n")
+}
+
+func TestAutoZero(t *testing.T) {
+	var out strings.Builder
+	ctx := NewContext()
+	ctx.Out = &out
+	ctx.AutoZero = true
+	ctx.Load(strings.NewReader("10 print y + 1\n"))
+	if err := ctx.RunProgram(); err != nil { t.Fatal(err) }
+	expect(t, out.String(), "1\n")
+	if len(ctx.Warnings) != 1 {
+		t.Errorf("expected one warning, got %v", ctx.Warnings)
+	}
+	runFailing(t, "10 print y + 1\n", "", "Variable not found: y")
+}
+
+func TestWarningsCommand(t *testing.T) {
+	out, err := execLines(t, "10 print 1", "10 print 2", "warnings", "warnings")
+	if err != nil { t.Fatal(err) }
+	expect(t, out, "Warning: Line 10 replaced\n")
+}
+
+func TestCheckNesting(t *testing.T) {
+	prog := Program{
+		10: "for i = 1 to 2",
+		20: "do",
+		30: "next i",
+		40: "loop until 1",
+		50: "if 1 then next",
+	}
+	want := []Warning{
+		{30, "NEXT closes DO from line 20"},
+		{40, "LOOP closes FOR from line 10"},
+	}
+	got := prog.CheckNesting()
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRenumber(t *testing.T) {
+	ctx := NewContext()
+	ctx.Program = Program{
+		5: "if x then 7 else 9",
+		7: "goto 5",
+		9: "gosub n * 2",
+	}
+	if !ctx.Renumber(10, 10) { t.Fatal("Renumber failed") }
+	want := Program{
+		10: "if x then 20 else 30",
+		20: "goto 10",
+		30: "gosub n * 2",
+	}
+	for ln, text := range want {
+		if ctx.Program[ln] != text {
+			t.Errorf("line %d: got %q, want %q", ln, ctx.Program[ln], text)
+		}
+	}
+	if len(ctx.Warnings) != 1 || ctx.Warnings[0].Line != 30 {
+		t.Errorf("expected a computed GOSUB warning, got %v", ctx.Warnings)
+	}
+	if ctx.Renumber(65000, 1000) {
+		t.Errorf("expected RENUM past the maximum line number to fail")
+	}
+}
+
+func TestRenumberOverflow(t *testing.T) {
+	out, err := execLines(t, "10 print 1", "20 print 2",
+		"renum 10, 9223372036854775807", "list")
+	if err != nil { t.Fatal(err) }
+	expect(t, out, "Warning: RENUM would need line numbers past the maximum of 65529\n" +
+		"10\tprint 1\n20\tprint 2\n")
+	ctx := NewContext()
+	ctx.MaxLineNumber = 0
+	ctx.Program = Program{10: "print 1", 20: "print 2"}
+	if ctx.Renumber(10, math.MaxInt) || ctx.Program[10] != "print 1" {
+		t.Errorf("expected RENUM to refuse line numbers that overflow")
+	}
+}
+
+func TestCallProcedure(t *testing.T) {
+	var got []float64
+	var out strings.Builder
+	ctx := NewContext()
+	ctx.Out = &out
+	ctx.RegisterProc("Beep", func (args []float64) error {
+		got = append(got, args...)
+		return nil
+	})
+	ctx.Load(strings.NewReader("10 call beep (440, 1 / 2)\n20 call beep\n"))
+	if err := ctx.RunProgram(); err != nil { t.Fatal(err) }
+	if len(got) != 2 || got[0] != 440 || got[1] != 0.5 {
+		t.Errorf("procedure got %v", got)
+	}
+	ctx.Load(strings.NewReader("10 call beep (\"a\")\n"))
+	if err := ctx.RunProgram(); err == nil {
+		t.Errorf("expected a type mismatch")
+	}
+	runFailing(t, "10 call nothing\n", "", "nothing")
+}
+
+func TestCallValueProcedure(t *testing.T) {
+	var got []Value
+	ctx := NewContext()
+	ctx.RegisterValueProc("say", func (args []Value) error {
+		got = args
+		return nil
+	})
+	ctx.Load(strings.NewReader("10 call say (\"hi\", ucase$(\"x\"), 3)\n"))
+	if err := ctx.RunProgram(); err != nil { t.Fatal(err) }
+	want := []Value{{Str: "hi", IsStr: true}, {Str: "X", IsStr: true}, {Num: 3}}
+	if len(got) != 3 || got[0] != want[0] || got[1] != want[1] ||
+			got[2] != want[2] {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFunctionArity(t *testing.T) {
+	for name, want := range map[string]int{"sin": 1, "max": 2, "pi": 0,
+			"clamp": 3, "ucase$": 1} {
+		if arity, ok := FunctionArity(name); !ok || arity != want {
+			t.Errorf("FunctionArity(%q) = %d, %v; want %d", name, arity, ok, want)
+		}
+	}
+	if _, ok := FunctionArity("nope"); ok {
+		t.Errorf("FunctionArity found an unknown function")
+	}
+}
+
+func TestEvalSafe(t *testing.T) {
+	value, err := EvalSafe("X * 2 + max(1, 3)", Variables{"x": 4})
+	if value != 11 || err != nil {
+		t.Errorf("got %v, %v; want 11", value, err)
+	}
+	for _, expr := range []string{"environ$(\"HOME\")", "argc()",
+			"param(1)", "1 2", "y", "rnd()", "timer()"} {
+		if _, err := EvalSafe(expr, nil); err == nil {
+			t.Errorf("EvalSafe(%q) should fail", expr)
+		}
+	}
+}
+
+func TestOutputRedirection(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "out.txt")
+	out := run(t, "10 print 1\n20 output \"" + fn + "\"\n30 print 2\n" +
+		"40 output\n50 print 3\n60 output \"" + fn + "\"\n70 print 4\n", "")
+	expect(t, out, "1\n3\n")
+	data, err := os.ReadFile(fn)
+	if err != nil { t.Fatal(err) }
+	expect(t, string(data), "4\n")
+	runFailing(t, "10 output\n", "", "OUTPUT is not redirected.")
+}
+
+func TestShell(t *testing.T) {
+	runFailing(t, "10 shell \"true\"\n", "", "SHELL is not allowed.")
+	var out strings.Builder
+	ctx := NewContext()
+	ctx.Out = &out
+	ctx.AllowShell = true
+	ctx.Load(strings.NewReader(
+		"10 shell \"echo hi\"\n20 shell \"exit 3\", code\n30 print code\n"))
+	if err := ctx.RunProgram(); err != nil { t.Fatal(err) }
+	expect(t, out.String(), "hi\n3\n")
+}
+
+func TestEnviron(t *testing.T) {
+	runFailing(t, "10 print environ$(\"HOME\")\n", "", "not allowed")
+	t.Setenv("TINYCAT_TEST", "before")
+	var out strings.Builder
+	ctx := NewContext()
+	ctx.Out = &out
+	ctx.AllowEnviron = true
+	ctx.Load(strings.NewReader(`10 print environ$("TINYCAT_TEST")
+20 setenv "TINYCAT_TEST", "after"
+30 print environ$("TINYCAT_TEST")
+`))
+	if err := ctx.RunProgram(); err != nil { t.Fatal(err) }
+	expect(t, out.String(), "before\nafter\n")
+}
+
+func TestArgs(t *testing.T) {
+	var out strings.Builder
+	ctx := NewContext()
+	ctx.Out = &out
+	ctx.Args = []string{"one", "two"}
+	ctx.Load(strings.NewReader("10 print argc(); \" \"; argv$(2)\n"))
+	if err := ctx.RunProgram(); err != nil { t.Fatal(err) }
+	expect(t, out.String(), "2 two\n")
+	runFailing(t, "10 print argv$(1)\n", "", "No such argument: 1")
+}
+
+func TestExitCode(t *testing.T) {
+	for source, want := range map[string]int{
+		"10 end 3\n20 print \"x\"\n": 3,
+		"10 stop 2\n": 2,
+		"10 end\n": 0,
+	} {
+		ctx := NewContext()
+		ctx.Out = &strings.Builder{}
+		ctx.Load(strings.NewReader(source))
+		if err := ctx.RunProgram(); err != nil { t.Fatal(err) }
+		if ctx.ExitCode != want {
+			t.Errorf("%q: exit code %d, want %d", source, ctx.ExitCode, want)
+		}
+	}
+}
+
+func TestRadixFunctions(t *testing.T) {
+	out := run(t, "10 print hex$(255); \" \"; oct$(8); \" \"; bin$(5); \" \"; hex$(0)\n", "")
+	expect(t, out, "FF 10 101 0\n")
+}
+
+func TestSeed(t *testing.T) {
+	out := run(t, `10 randomize 42
+20 a = rnd()
+30 randomize seed()
+40 print a = rnd(); " "; seed()
+`, "")
+	expect(t, out, "-1 42\n")
+}
+
+func TestContextRandom(t *testing.T) {
+	first, second := NewContext(), NewContext()
+	for _, ctx := range []*Context{first, second} {
+		ctx.Load(strings.NewReader("10 randomize 7\n"))
+		if err := ctx.RunProgram(); err != nil { t.Fatal(err) }
+	}
+	a := first.Random().Float64()
+	first.Random().Float64() // Doesn't disturb the other context.
+	if b := second.Random().Float64(); a != b {
+		t.Errorf("contexts with the same seed gave %v and %v", a, b)
+	}
+}
+
+func TestLike(t *testing.T) {
+	out := run(t, `10 print like("hello", "h*o"); like("hello", "h?llo"); like("hi", "h")
+20 print like("", "*"); like("abc", "*c*"); like("ab", "a?c")
+`, "")
+	expect(t, out, "-1-10\n-1-10\n")
+}
+
+func TestFormat(t *testing.T) {
+	out := run(t, `10 print format$("% + % = %, 100%%", 1, 2, 3)
+20 print format$("[%]", "text")
+`, "")
+	expect(t, out, "1 + 2 = 3, 100%\n[text]\n")
+	runFailing(t, "10 print format$(\"% %\", 1)\n", "", "format$")
+}
+
+func TestSplitReplace(t *testing.T) {
+	out := run(t, `10 print split$("a,b,c", ",", 2); "|"; split$("a,b", ",", 5); "|"
+20 print replace$("aXbX", "X", "-"); " "; replace$("abc", "", "-")
+`, "")
+	expect(t, out, "b||\na-b- abc\n")
+}
+
+func TestLineContinuation(t *testing.T) {
+	out := run(t, "10 print 1 + _\n  2, _\n  \"a _\"\n20 print \"b\"\n", "")
+	expect(t, out, "3a _\nb\n")
+	if text, ok := ContinuedLine(`print "x _"`); ok || text != `print "x _"` {
+		t.Errorf("an underscore inside a string continued the line")
+	}
+}
+
+func TestUnderscoreNames(t *testing.T) {
+	out := run(t, "10 let my_var2 = 3\n20 print my_var2 * 2\n", "")
+	expect(t, out, "6\n")
+	runFailing(t, "10 let _x = 1\n", "", "Variable expected")
+}
+
+func TestLeadingPoint(t *testing.T) {
+	out := run(t, "10 print .5 + 1; \" \"; -.25\n", "")
+	expect(t, out, "1.5 -0.25\n")
+	runFailing(t, "10 print .\n", "", "Expression expected")
+}
+
+func TestInexactLineNumberWarning(t *testing.T) {
+	ctx := NewContext()
+	ctx.Out = &strings.Builder{}
+	ctx.Load(strings.NewReader("10 goto 2 ^ 60\n"))
+	if err := ctx.RunProgram(); err == nil { t.Fatal("expected an error") }
+	want := Warning{10, "Line number 1.152921504606847e+18 is too large to be exact"}
+	if len(ctx.Warnings) != 1 || ctx.Warnings[0] != want {
+		t.Errorf("got warnings %v, want %v", ctx.Warnings, []Warning{want})
+	}
+}
+
+func TestListPretty(t *testing.T) {
+	out, err := execLines(t, "10 for i = 1 to 2", "20 do while i > 5",
+		"30 loop", "40 print i", "50 next i", "list pretty")
+	if err != nil { t.Fatal(err) }
+	expect(t, out, "10\tfor i = 1 to 2\n20\t  do while i > 5\n30\t  loop\n"+
+		"40\t  print i\n50\tnext i\n")
+}
+
+func TestInputWholeNumbers(t *testing.T) {
+	out := run(t, "10 input n%\n20 print n * 2\n", "2.5\n3\n")
+	expect(t, out, "?Redo from start\n6\n")
+}
+
+func TestInputRetryLimit(t *testing.T) {
+	var out strings.Builder
+	ctx := NewContext()
+	ctx.In = strings.NewReader("a\nb\nc\n4\n")
+	ctx.Out = &out
+	ctx.MaxInputRetries = 1
+	ctx.Load(strings.NewReader("10 input n\n"))
+	err := ctx.RunProgram()
+	if err == nil || !strings.Contains(err.Error(), "Too many retries for INPUT") {
+		t.Errorf("expected too many retries, got: %v", err)
+	}
+	expect(t, out.String(), "?Redo from start\n?Redo from start\n")
+}
+
+func TestInputMoreValues(t *testing.T) {
+	out := run(t, "10 input a, b, c\n20 print a + b + c\n", "1\n2, 3\n")
+	expect(t, out, "?? 6\n")
+	out = run(t, "10 input a, b\n20 print a; b\n", "7\n")
+	expect(t, out, "?? 70\n")
+}
+
+func TestParamAndLocal(t *testing.T) {
+	out := run(t, `10 x = 1
+20 gosub 100 (4, 5)
+30 print x
+40 end
+100 local x
+110 x = param(1) * param(2)
+120 print x
+130 return
+`, "")
+	expect(t, out, "20\n1\n")
+	runFailing(t, "10 print param(1)\n", "", "PARAM outside subroutine")
+}
+
+func TestTraceback(t *testing.T) {
+	runFailing(t, `10 gosub 100
+20 end
+100 gosub 200
+110 return
+200 print y
+210 return
+`, "", "Variable not found: y in line 200, column 7 (called from lines 100, 10)")
+	runFailing(t, "10 gosub 100\n20 end\n100 print y\n", "",
+		"(called from line 10)")
+}
+
+func TestStackCommand(t *testing.T) {
+	out, err := execLines(t, "10 gosub 100", "20 end", "100 for i = 1 to 2",
+		"110 stop", "120 next i", "run", "stack")
+	if err != nil { t.Fatal(err) }
+	if !strings.HasSuffix(out, "FOR i = 1 TO 2 STEP 1 in line 100\nGOSUB in line 10\n") {
+		t.Errorf("got output:\n%s", out)
+	}
+}
+
+func TestDepthFunctions(t *testing.T) {
+	out := run(t, `10 print gosubdepth; " "; loopdepth
+20 for i = 1 to 1
+30 gosub 100
+40 next i
+50 end
+100 print gosubdepth; " "; loopdepth
+110 return
+`, "")
+	expect(t, out, "0 0\n1 1\n")
+}
+
+func TestIncludeErrors(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.bas": "include \"b.bas\"\n10 print 1\n",
+		"b.bas": "include \"a.bas\"\n20 print 2\n",
+		"c.bas": "include \"d.bas\"\n10 print 1\n",
+		"d.bas": "10 print 2\n",
+	}
+	for name, text := range files {
+		fn := filepath.Join(dir, name)
+		if err := os.WriteFile(fn, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, message := range map[string]string{
+		"a.bas": "Include cycle: ", "c.bas": "Line 10 is already in "} {
+		err := NewContext().LoadFile(filepath.Join(dir, name))
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%s: expected an error containing %q, got: %v",
+				name, message, err)
+		}
+	}
+	out := runFiles(t, "main.bas", "include \"lib.bas\"\n10 print 1\n",
+		"lib.bas", "20 print 2\n")
+	expect(t, out, "1\n2\n")
+}
+
+func TestForIterationCounts(t *testing.T) {
+	out := run(t, `10 n = 0
+20 for i = 1 to 3
+30 for j = i to 2
+40 n = n + 1
+50 next j
+60 next i
+70 print n; " "; i; " "; j
+80 for k = 10 to 1 step -3
+90 n = n + 1
+100 next k
+110 print n; " "; k
+`, "")
+	expect(t, out, "3 4 3\n7 -2\n")
+}
+
+func TestTwoCharacterRelations(t *testing.T) {
+	out := run(t, `10 if 1 <= 1 then print "a";
+20 if 1 <> 2 then print "b";
+30 if 2 >= 2 then print "c";
+40 if 1 =< 1 then print "d";
+50 if 1 >< 2 then print "e";
+60 if 2 => 3 then print "x";
+70 print
+`, "")
+	expect(t, out, "abcde\n")
+}
+
+func TestLoadSaveErrors(t *testing.T) {
+	dir := t.TempDir()
+	_, err := execLines(t, "load \"" + filepath.Join(dir, "none.bas") + "\"")
+	if err == nil || !os.IsNotExist(err) {
+		t.Errorf("expected a missing file, got: %v", err)
+	}
+	fn := filepath.Join(dir, "prog.bas")
+	out, err := execLines(t, "10 print 7", "save \"" + fn + "\"", "new",
+		"load \"" + fn + "\"", "run")
+	if err != nil { t.Fatal(err) }
+	if !strings.HasSuffix(out, "File saved.\nFile loaded.\n7\n") {
+		t.Errorf("got output:\n%s", out)
+	}
+	_, err = execLines(t, "10 print 7",
+		"save \"" + filepath.Join(dir, "no", "prog.bas") + "\"")
+	if err == nil { t.Error("expected an error saving into a missing directory") }
+}
+
+// Run main in a child process on the given program, for its exit status.
+func TestMainExitStatus(t *testing.T) {
+	if fn := os.Getenv("BASIC_TEST_MAIN"); fn != "" {
+		os.Args = []string{"basic", fn}
+		main()
+		return
+	}
+	dir := t.TempDir()
+	for source, failing := range map[string]bool{
+		"10 print 1\n": false, "10 stop\n": false, "10 print y\n": true} {
+		fn := filepath.Join(dir, "prog.bas")
+		if err := os.WriteFile(fn, []byte(source), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command(os.Args[0], "-test.run=^TestMainExitStatus$")
+		cmd.Env = append(os.Environ(), "BASIC_TEST_MAIN=" + fn)
+		err := cmd.Run()
+		if _, ok := err.(*exec.ExitError); ok != failing || (!ok && err != nil) {
+			t.Errorf("%q: got %v, want failing %v", source, err, failing)
+		}
+	}
+}